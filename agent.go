@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Agents, the values of the agent key: what edits the Bazel files in each
+// attempt of the matrix runner.
+const (
+	agentAider   = "aider"   // aider, run as a command
+	agentNative  = "native"  // bld's own tool-calling loop; see buildAgent
+	agentOneShot = "oneshot" // a single request per attempt; see runLLM
+)
+
+const (
+	// maxAgentTurns bounds the requests of one run of the native agent.
+	maxAgentTurns = 30
+	// maxToolOutput bounds what a tool returns to the model; longer
+	// outputs keep their end, where bazel reports what went wrong.
+	maxToolOutput = 16 << 10
+)
+
+// agentSystemPrompt tells the native agent how to use its tools and which
+// files p lets it write. The task itself is the aider prompt, sent as the
+// user message.
+func agentSystemPrompt(p policyConfig) string {
+	return `You make a Bazel target build by editing the Bazel files of a repository, using the tools you are given. Paths are relative to the repository root.
+
+You can read any file and list any directory, but you can only write the Bazel files matching ` + strings.Join(p.AllowedFiles, ", ") + `; do not try to change source code. write_file replaces the whole file. Check your changes with bazel_query and bazel_build.
+
+When the target builds, or you cannot make further progress, reply without calling a tool and summarize what you changed.`
+}
+
+// agentTools are the functions offered to the native agent.
+var agentTools = []chatTool{
+	{Type: "function", Function: toolFunction{
+		Name:        "read_file",
+		Description: "Read a file of the repository.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"file path relative to the repository root"}},"required":["path"]}`),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "list_dir",
+		Description: "List a directory of the repository. Subdirectories end with a slash.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"directory path relative to the repository root; \".\" is the root"}},"required":["path"]}`),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "write_file",
+		Description: "Create or replace a Bazel file that you are allowed to write. The content must parse as Starlark; it is formatted like buildifier would.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"file path relative to the repository root"},"content":{"type":"string","description":"the whole new content of the file"}},"required":["path","content"]}`),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "bazel_query",
+		Description: "Run 'bazel query' and return its output.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string","description":"the query expression, such as \"//crates/cli:all\""}},"required":["query"]}`),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "bazel_build",
+		Description: "Run 'bazel build' and return its output.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"target":{"type":"string","description":"the label or pattern to build, such as \"//crates/cli:grep_cli\""}},"required":["target"]}`),
+	}},
+}
+
+// buildAgent is bld's own alternative to aider: a loop in which a model edits
+// the Bazel files of a worktree through a small set of tools, called with
+// function calling, until it replies without calling one. The tools only
+// write Bazel files, so the agent cannot change anything else.
+type buildAgent struct {
+	r       runner
+	cfg     *config
+	client  *openAIClient
+	limiter *rateLimiter
+	// model is the name the user gave and name the one the provider knows
+	// the model by.
+	model, name string
+	// dir is the worktree the tools work in.
+	dir string
+	// transcript receives the conversation, for the attempt's artifacts.
+	transcript io.Writer
+}
+
+// newBuildAgent returns an agent sending requests for model to its provider,
+// which must have an OpenAI-compatible API.
+func newBuildAgent(r runner, cfg *config, model, dir string, transcript io.Writer) (*buildAgent, error) {
+	provider, name := modelProvider(cfg, model)
+	pc, ok := cfg.Providers[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", provider)
+	}
+	if pc.Type != providerOpenAI && pc.Type != "" {
+		return nil, fmt.Errorf("the native agent needs an openai provider; %s of model %s is %s", provider, model, pc.Type)
+	}
+	return &buildAgent{
+		r:          r,
+		cfg:        cfg,
+		client:     newOpenAIClient(pc.BaseURL, os.Getenv(pc.APIKeyEnv)),
+		limiter:    providerLimiter(cfg, provider),
+		model:      model,
+		name:       name,
+		dir:        dir,
+		transcript: transcript,
+	}, nil
+}
+
+// run gives task to the model and carries out the tool calls of its replies
+// until it replies without any or has had maxAgentTurns replies. It returns
+// the usage of every request and how many failed requests were retried; the
+// usage is returned even if run fails.
+func (a *buildAgent) run(ctx context.Context, task string) (tokenUsage, int, error) {
+	logger := loggerFrom(ctx)
+	messages := []chatMessage{
+		{Role: "system", Content: agentSystemPrompt(a.cfg.Policy)},
+		{Role: "user", Content: task},
+	}
+	a.record(ctx, "user", task)
+	var u tokenUsage
+	var retries int
+	for turn := 1; turn <= maxAgentTurns; turn++ {
+		resp, n, err := a.chat(ctx, messages)
+		retries += n
+		if err != nil {
+			return u, retries, err
+		}
+		u.add(resp.Usage.tokenUsage())
+		msg := resp.Choices[0].Message
+		msg.Role = "assistant"
+		messages = append(messages, msg)
+		if strings.TrimSpace(msg.Content) != "" {
+			a.record(ctx, "assistant", msg.Content)
+		}
+		if len(msg.ToolCalls) == 0 {
+			logger.Printf("Agent for %s finished after %d turns", a.model, turn)
+			return u, retries, nil
+		}
+		for _, call := range msg.ToolCalls {
+			a.record(ctx, "call", call.Function.Name+" "+call.Function.Arguments)
+			out, err := a.call(ctx, call.Function.Name, call.Function.Arguments)
+			if err != nil {
+				if ctx.Err() != nil {
+					return u, retries, ctx.Err()
+				}
+				// The model is told what went wrong and may try again.
+				out = "error: " + err.Error()
+			}
+			a.record(ctx, "result", out)
+			messages = append(messages, chatMessage{Role: "tool", Content: out, ToolCallID: call.ID})
+		}
+	}
+	logger.Printf("Agent for %s used all %d turns", a.model, maxAgentTurns)
+	return u, retries, nil
+}
+
+// chat sends messages to the model, retrying transient failures, and
+// returns the reply and the number of retries.
+func (a *buildAgent) chat(ctx context.Context, messages []chatMessage) (*chatResponse, int, error) {
+	req := chatRequest{Model: a.name, Messages: messages, Tools: agentTools}
+	var resp *chatResponse
+	retries, err := retry(ctx, a.cfg.Retry, "request to "+a.model, isTransientLLMError, func() error {
+		if a.limiter != nil {
+			if err := a.limiter.wait(ctx); err != nil {
+				return err
+			}
+		}
+		ctx := ctx
+		if t := a.cfg.Timeouts["llm"]; t > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
+		}
+		var err error
+		resp, err = a.client.chat(ctx, req)
+		return err
+	})
+	if err != nil {
+		if retries > 0 {
+			return nil, retries, fmt.Errorf("request to %s failed after %d retries: %w", a.model, retries, err)
+		}
+		return nil, retries, fmt.Errorf("request to %s failed: %w", a.model, err)
+	}
+	return resp, retries, nil
+}
+
+// call runs the tool name with the JSON-encoded args. Its error is for the
+// model to read.
+func (a *buildAgent) call(ctx context.Context, name, args string) (string, error) {
+	var in struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+		Query   string `json:"query"`
+		Target  string `json:"target"`
+	}
+	if err := json.Unmarshal([]byte(args), &in); err != nil {
+		return "", fmt.Errorf("arguments are not a JSON object: %w", err)
+	}
+	logger := loggerFrom(ctx)
+	switch name {
+	case "read_file":
+		return a.readFile(in.Path)
+	case "list_dir":
+		return a.listDir(in.Path)
+	case "write_file":
+		if err := a.writeFile(in.Path, in.Content); err != nil {
+			return "", err
+		}
+		logger.Printf("Agent for %s wrote %s", a.model, in.Path)
+		return "wrote " + in.Path, nil
+	case "bazel_query":
+		if err := checkBazelArg(in.Query); err != nil {
+			return "", err
+		}
+		logger.Printf("Agent for %s runs bazel query %s", a.model, in.Query)
+		out, err := runBazelQueryTarget(ctx, a.r, a.dir, in.Query)
+		return toolOutput(out, err), nil
+	case "bazel_build":
+		if err := checkBazelArg(in.Target); err != nil {
+			return "", err
+		}
+		logger.Printf("Agent for %s runs bazel build %s", a.model, in.Target)
+		out, err := runBazelBuild(ctx, a.r, a.dir, in.Target)
+		return toolOutput(out, err), nil
+	}
+	return "", fmt.Errorf("unknown tool %q", name)
+}
+
+// readFile returns the content of the file at rel, cut to maxToolOutput.
+func (a *buildAgent) readFile(rel string) (string, error) {
+	root, rel, err := a.open(rel)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	f, err := root.Open(rel)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxToolOutput+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxToolOutput {
+		return string(data[:maxToolOutput]) + "\n... (truncated)", nil
+	}
+	return string(data), nil
+}
+
+// listDir returns the entries of the directory at rel, one per line.
+func (a *buildAgent) listDir(rel string) (string, error) {
+	root, rel, err := a.open(rel)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	f, err := root.Open(rel)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, e := range entries {
+		switch {
+		case e.Name() == ".git":
+		case e.IsDir():
+			names = append(names, e.Name()+"/")
+		default:
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return strings.Join(names, "\n"), nil
+}
+
+// writeFile formats content and writes it to the Bazel file at rel. Files
+// that are not Bazel files, that policy.allowed_files does not allow or that
+// do not parse are refused.
+func (a *buildAgent) writeFile(rel, content string) error {
+	root, rel, err := a.open(rel)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if name := filepath.ToSlash(rel); !isBazelFileName(path.Base(name)) || !a.cfg.Policy.allows(name) {
+		return fmt.Errorf("%s may not be written; only Bazel files matching %s may be", name, strings.Join(a.cfg.Policy.AllowedFiles, ", "))
+	}
+	formatted, err := formatBazelFile(rel, []byte(content))
+	if err != nil {
+		return fmt.Errorf("not written: %w", err)
+	}
+	f, err := root.OpenFile(rel, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("directory %s does not exist", path.Dir(filepath.ToSlash(rel)))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(formatted)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// open checks that rel names a path in the worktree outside .git and
+// returns the worktree as an os.Root, which keeps symbolic links from
+// leading out of it, and rel in the form the root expects.
+func (a *buildAgent) open(rel string) (*os.Root, string, error) {
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if !filepath.IsLocal(rel) {
+		return nil, "", fmt.Errorf("%s is not a path inside the repository", rel)
+	}
+	if first, _, _ := strings.Cut(filepath.ToSlash(rel), "/"); first == ".git" {
+		return nil, "", fmt.Errorf("%s is in .git", rel)
+	}
+	root, err := os.OpenRoot(a.dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, rel, nil
+}
+
+// record adds an entry to the transcript. Failures to write it are logged
+// rather than failing the attempt.
+func (a *buildAgent) record(ctx context.Context, kind, text string) {
+	if a.transcript == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(a.transcript, "--- %s ---\n%s\n\n", kind, strings.TrimRight(text, "\n")); err != nil {
+		loggerFrom(ctx).Print(err)
+	}
+}
+
+// checkBazelArg refuses arguments bazel would take as options.
+func checkBazelArg(arg string) error {
+	if strings.TrimSpace(arg) == "" {
+		return errors.New("missing argument")
+	}
+	if strings.HasPrefix(strings.TrimSpace(arg), "-") {
+		return fmt.Errorf("%q is an option; only targets and query expressions are allowed", arg)
+	}
+	return nil
+}
+
+// toolOutput describes the result of a bazel run for the model, keeping the
+// end of long outputs.
+func toolOutput(out []byte, err error) string {
+	if len(out) > maxToolOutput {
+		out = append([]byte("(output truncated) ...\n"), out[len(out)-maxToolOutput:]...)
+	}
+	status := "succeeded"
+	if err != nil {
+		status = err.Error()
+	}
+	return fmt.Sprintf("%s\n%s", status, out)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	cfg := defaultConfig()
+	a := &buildAgent{cfg: cfg, dir: t.TempDir()}
+	if err := a.writeFile("BUILD.bazel", "rust_library(name=\"a\")"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(a.dir, "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "rust_library(name = \"a\")\n" {
+		t.Errorf("wrote %q, want it formatted", got)
+	}
+	for _, rel := range []string{"src/main.rs", "../BUILD.bazel", "WORKSPACE"} {
+		if err := a.writeFile(rel, ""); err == nil {
+			t.Errorf("%s written", rel)
+		}
+	}
+
+	// A configured policy narrows what may be written.
+	cfg.Policy.AllowedFiles = []string{"BUILD.bazel"}
+	if err := a.writeFile("MODULE.bazel", "module(name = \"m\")\n"); err == nil || !strings.Contains(err.Error(), "only Bazel files matching BUILD.bazel") {
+		t.Errorf("err = %v, want MODULE.bazel refused", err)
+	}
+	if !strings.Contains(agentSystemPrompt(cfg.Policy), "only write the Bazel files matching BUILD.bazel;") {
+		t.Errorf("system prompt does not name the allowed files:\n%s", agentSystemPrompt(cfg.Policy))
+	}
+}
+
+func TestBuildAgentRun(t *testing.T) {
+	var turns atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.Model != "m" || len(req.Tools) != len(agentTools) {
+			t.Errorf("request for %s with %d tools", req.Model, len(req.Tools))
+		}
+		switch turns.Add(1) {
+		case 1:
+			if len(req.Messages) != 2 || req.Messages[0].Role != "system" || req.Messages[1].Content != "make //:a build" {
+				t.Errorf("first request = %+v", req.Messages)
+			}
+			fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Writing the BUILD file.","tool_calls":[`+
+				`{"id":"call_1","type":"function","function":{"name":"write_file","arguments":"{\"path\":\"BUILD.bazel\",\"content\":\"rust_library(name=\\\"a\\\")\"}"}},`+
+				`{"id":"call_2","type":"function","function":{"name":"bazel_build","arguments":"{\"target\":\"//:a\"}"}}`+
+				`]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":100,"completion_tokens":20,"cost":0.01}}`)
+		case 2:
+			// The conversation so far, with a result for each call.
+			want := []chatMessage{
+				{Role: "tool", Content: "wrote BUILD.bazel", ToolCallID: "call_1"},
+				{Role: "tool", Content: "succeeded\nINFO: Build completed successfully\n", ToolCallID: "call_2"},
+			}
+			if len(req.Messages) != 5 || req.Messages[2].Role != "assistant" || len(req.Messages[2].ToolCalls) != 2 {
+				t.Fatalf("second request = %+v", req.Messages)
+			}
+			if got := req.Messages[3:]; !reflect.DeepEqual(got, want) {
+				t.Errorf("tool results = %+v, want %+v", got, want)
+			}
+			fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"//:a builds."},"finish_reason":"stop"}],"usage":{"prompt_tokens":150,"completion_tokens":5,"cost":0.02}}`)
+		default:
+			t.Error("request after the final answer")
+		}
+	}))
+	defer srv.Close()
+
+	cfg := defaultConfig()
+	cfg.Providers["test"] = providerConfig{Type: providerOpenAI, BaseURL: srv.URL}
+	cfg.DefaultProvider = "test"
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		return &result{Combined: []byte("INFO: Build completed successfully\n")}, nil
+	}}
+	var transcript strings.Builder
+	a, err := newBuildAgent(r, cfg, "m", t.TempDir(), &transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, retries, err := a.run(context.Background(), "make //:a build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turns.Load() != 2 || retries != 0 {
+		t.Errorf("%d turns, %d retries; want 2 turns", turns.Load(), retries)
+	}
+	if u.PromptTokens != 250 || u.CompletionTokens != 25 || u.CostUSD < 0.03-1e-9 || u.CostUSD > 0.03+1e-9 {
+		t.Errorf("usage = %+v, want both turns'", u)
+	}
+	if got, err := os.ReadFile(filepath.Join(a.dir, "BUILD.bazel")); err != nil || string(got) != "rust_library(name = \"a\")\n" {
+		t.Errorf("BUILD.bazel = %q, %v", got, err)
+	}
+	if len(r.Commands) != 1 || r.Commands[0].String() != "bazel build //:a" || r.Commands[0].Dir != a.dir {
+		t.Errorf("ran %v", r.Commands)
+	}
+	for _, want := range []string{
+		"--- user ---\nmake //:a build\n",
+		"--- assistant ---\nWriting the BUILD file.\n",
+		"--- call ---\nwrite_file {",
+		"--- result ---\nwrote BUILD.bazel\n",
+		"--- call ---\nbazel_build {\"target\":\"//:a\"}\n",
+		"--- assistant ---\n//:a builds.\n",
+	} {
+		if !strings.Contains(transcript.String(), want) {
+			t.Errorf("transcript does not contain %q:\n%s", want, transcript.String())
+		}
+	}
+}
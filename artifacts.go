@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Artifact file names. Not every attempt has every file.
+const (
+	artifactPrompt      = "prompt.txt"       // the aider message or system prompt
+	artifactInput       = "input.txt"        // the user message sent with the prompt
+	artifactResponse    = "response.md"      // the model's reply
+	artifactAiderLog    = "aider.log"        // aider's output, from every run
+	artifactAgentLog    = "agent.log"        // the native agent's conversation
+	artifactParseErrors = "parse-errors.txt" // why the files did not parse
+	artifactReplyErrors = "reply-errors.txt" // why a one-shot reply was rejected
+	artifactDiff        = "diff.patch"       // the attempt's changes to the worktree
+	artifactPolicy      = "policy.txt"       // the files changed outside policy.allowed_files
+	artifactBazelQuery  = "bazel-query.log"  // the output of bazel query
+	artifactBazelBuild  = "bazel-build.log"  // the output of bazel build
+	artifactOutcome     = "outcome.txt"      // how the attempt ended
+)
+
+// runArtifactDir returns the directory holding the artifacts of model's
+// attempts at target in run runID:
+// <worktreeBaseDir>/runs/<run-id>/<model>/<target>.
+func runArtifactDir(worktreeBaseDir, runID, model, target string) string {
+	return filepath.Join(worktreeBaseDir, "runs", runID, sanitizePath(model), sanitizePath(strings.TrimPrefix(target, "//")))
+}
+
+// attemptArtifacts records what happened in one attempt, in a directory of
+// its own so that failed attempts can be inspected after the run.
+type attemptArtifacts struct {
+	dir string
+}
+
+// newAttemptArtifacts creates the directory of attempt under dir, a
+// runArtifactDir, replacing that of an earlier try at the attempt.
+func newAttemptArtifacts(dir string, attempt int) (*attemptArtifacts, error) {
+	a := &attemptArtifacts{dir: filepath.Join(dir, strconv.Itoa(attempt))}
+	if err := os.RemoveAll(a.dir); err != nil {
+		return nil, fmt.Errorf("error clearing artifact directory: %w", err)
+	}
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating artifact directory: %w", err)
+	}
+	return a, nil
+}
+
+// write saves an artifact.
+func (a *attemptArtifacts) write(name string, data []byte) error {
+	if err := os.WriteFile(filepath.Join(a.dir, name), data, 0644); err != nil {
+		return fmt.Errorf("error writing artifact: %w", err)
+	}
+	return nil
+}
+
+// appendTo adds data to an artifact.
+func (a *attemptArtifacts) appendTo(name string, data []byte) error {
+	f, err := os.OpenFile(filepath.Join(a.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing artifact: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing artifact: %w", err)
+	}
+	return nil
+}
+
+// writeDiff saves the changes of the worktree at dir, untracked files
+// included, as diff.patch.
+func (a *attemptArtifacts) writeDiff(ctx context.Context, r runner, dir string) error {
+	diff, err := gitDiffAll(ctx, r, dir)
+	if err != nil {
+		return err
+	}
+	return a.write(artifactDiff, diff)
+}
+
+// create opens an artifact for writing.
+func (a *attemptArtifacts) create(name string) (*os.File, error) {
+	f, err := os.Create(filepath.Join(a.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("error writing artifact: %w", err)
+	}
+	return f, nil
+}
+
+// outcome saves how the attempt ended.
+func (a *attemptArtifacts) outcome(format string, args ...any) error {
+	return a.write(artifactOutcome, []byte(fmt.Sprintf(format, args...)+"\n"))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// attemptRefPrefix is the namespace of the refs that keep the failed attempts
+// of bld matrix: refs/bld/<run-id>/<model>/<target>/<attempt>.
+const attemptRefPrefix = "refs/bld/"
+
+// maxAttemptDetails bounds the output kept in the commit message of a failed
+// attempt.
+const maxAttemptDetails = 8 << 10
+
+// attemptRef returns the ref keeping model's failed attempt at target in run
+// runID. attempt is the attempt's number, or names it otherwise.
+func attemptRef(runID, model, target, attempt string) string {
+	return attemptRefPrefix + runID + "/" + refComponent(model) + "/" + refComponent(strings.TrimPrefix(target, "//")) + "/" + attempt
+}
+
+// refComponent makes s a valid component of a git ref name by replacing the
+// characters git does not allow, and the slashes, with hyphens.
+func refComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, s)
+	for strings.Contains(s, "..") {
+		s = strings.ReplaceAll(s, "..", "-.")
+	}
+	if s == "" || strings.HasPrefix(s, ".") {
+		s = "-" + s
+	}
+	if strings.HasSuffix(s, ".") || strings.HasSuffix(s, ".lock") {
+		s += "-"
+	}
+	return s
+}
+
+// attemptMessage returns the commit message of a failed attempt: a subject
+// naming the attempt and its outcome, and the tail of details, the output
+// explaining the failure, as the body.
+func attemptMessage(agent, model, target, attempt, outcome string, details []byte) string {
+	outcome, _, _ = strings.Cut(outcome, "\n")
+	msg := fmt.Sprintf("%s: model %s target %s attempt %s: %s", agent, model, target, attempt, outcome)
+	if d := outputTail(details, maxAttemptDetails); d != "" {
+		msg += "\n\n" + d
+	}
+	return msg
+}
+
+// savedAttempt is a failed attempt kept under attemptRefPrefix.
+type savedAttempt struct {
+	Ref     string
+	Run     string
+	Model   string
+	Target  string
+	Attempt string
+	Date    string
+	Subject string
+}
+
+// name returns the attempt's ref relative to attemptRefPrefix.
+func (a *savedAttempt) name() string {
+	return strings.TrimPrefix(a.Ref, attemptRefPrefix)
+}
+
+// listSavedAttempts returns the failed attempts kept in the repo at dir, in
+// the order of their refs, which is that of their runs.
+func listSavedAttempts(ctx context.Context, r runner, dir string) ([]*savedAttempt, error) {
+	res, err := r.Run(ctx, newCommand(dir, "git", "for-each-ref", "--format=%(refname)%00%(committerdate:iso-strict)%00%(subject)", attemptRefPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref failed in %s: %w", dir, outputError(err, res))
+	}
+	var attempts []*savedAttempt
+	for _, line := range strings.Split(string(res.Stdout), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(fields[0], attemptRefPrefix), "/")
+		if len(parts) != 4 {
+			// Not a ref of bld's.
+			continue
+		}
+		attempts = append(attempts, &savedAttempt{
+			Ref:     fields[0],
+			Run:     parts[0],
+			Model:   parts[1],
+			Target:  parts[2],
+			Attempt: parts[3],
+			Date:    fields[1],
+			Subject: fields[2],
+		})
+	}
+	return attempts, nil
+}
+
+// expiredAttempts returns the attempts of all but the keep most recent runs,
+// and those runs.
+func expiredAttempts(attempts []*savedAttempt, keep int) ([]*savedAttempt, []string) {
+	var runs []string
+	for _, a := range attempts {
+		if !slices.Contains(runs, a.Run) {
+			runs = append(runs, a.Run)
+		}
+	}
+	// Run IDs are UTC timestamps, so they sort in the order the runs started.
+	slices.Sort(runs)
+	drop := runs[:max(len(runs)-keep, 0)]
+	var expired []*savedAttempt
+	for _, a := range attempts {
+		if slices.Contains(drop, a.Run) {
+			expired = append(expired, a)
+		}
+	}
+	return expired, drop
+}
+
+// attemptCommands are the commands of "bld attempts".
+var attemptCommands = []subcommand{
+	{"list", "list the failed attempts kept by matrix runs", listAttempts},
+	{"show", "show the message and changes of a failed attempt", showAttempt},
+	{"gc", "delete the failed attempts of all but the most recent runs", gcAttempts},
+}
+
+// runAttempts lists, shows or deletes the failed attempts of bld matrix,
+// which are kept as commits on refs under attemptRefPrefix in the repo.
+func runAttempts(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		for _, sc := range attemptCommands {
+			if sc.name == args[0] {
+				return sc.run(ctx, args[1:])
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "usage: bld attempts <command> [flags]\n\nThe commands are:\n\n")
+	for _, sc := range attemptCommands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", sc.name, sc.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"bld attempts <command> -h\" for more information about a command.\n")
+	switch {
+	case len(args) == 0:
+		return fmt.Errorf("missing command")
+	case args[0] == "help" || args[0] == "-h" || args[0] == "--help":
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// listAttempts prints the failed attempts kept in the repo, optionally only
+// those of a run, or of the models and targets passed with -models and
+// -targets; those of the config file do not filter.
+func listAttempts(ctx context.Context, args []string) error {
+	fs := newFlagSet("attempts list")
+	common := registerCommonFlags(fs)
+	run := fs.String("run", "", "list only the attempts of this run ID; \"last\" for the most recent run")
+	fs.Parse(args)
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	attempts, err := listSavedAttempts(ctx, newRunner(cfg), cfg.Repo)
+	if err != nil {
+		return err
+	}
+	if *run == "last" && len(attempts) > 0 {
+		*run = slices.MaxFunc(attempts, func(a, b *savedAttempt) int { return strings.Compare(a.Run, b.Run) }).Run
+	}
+	var models, targets []string
+	for _, m := range common.models {
+		models = append(models, refComponent(m))
+	}
+	for _, t := range common.targets {
+		targets = append(targets, refComponent(strings.TrimPrefix(t, "//")))
+	}
+	for _, a := range attempts {
+		if *run != "" && a.Run != *run ||
+			len(models) > 0 && !slices.Contains(models, a.Model) ||
+			len(targets) > 0 && !slices.Contains(targets, a.Target) {
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", a.name(), a.Date, a.Subject)
+	}
+	return nil
+}
+
+// showAttempt prints the message, the files changed and the diff of a failed
+// attempt, named by its ref or by the ref relative to attemptRefPrefix as
+// "bld attempts list" prints it.
+func showAttempt(ctx context.Context, args []string) error {
+	fs := newFlagSet("attempts show")
+	common := registerCommonFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("want one attempt, as printed by \"bld attempts list\"")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	ref := fs.Arg(0)
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = attemptRefPrefix + ref
+	}
+	res, err := newRunner(cfg).Run(ctx, newCommand(cfg.Repo, "git", "show", "--stat", "--patch", ref, "--"))
+	if err != nil {
+		return fmt.Errorf("error showing attempt %s: %w", fs.Arg(0), outputError(err, res))
+	}
+	_, err = os.Stdout.Write(res.Stdout)
+	return err
+}
+
+// gcAttempts deletes the refs of the failed attempts of all but the most
+// recent runs. The commits themselves are left for git gc to prune.
+func gcAttempts(ctx context.Context, args []string) error {
+	fs := newFlagSet("attempts gc")
+	common := registerCommonFlags(fs)
+	keep := fs.Int("keep", 1, "number of most recent runs whose attempts are kept")
+	dryRun := fs.Bool("dry-run", false, "print the refs that would be deleted without deleting them")
+	fs.Parse(args)
+	if *keep < 0 {
+		return fmt.Errorf("-keep: must not be negative")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	r := newRunner(cfg)
+	attempts, err := listSavedAttempts(ctx, r, cfg.Repo)
+	if err != nil {
+		return err
+	}
+	expired, drop := expiredAttempts(attempts, *keep)
+
+	var stdin strings.Builder
+	for _, a := range expired {
+		if *dryRun {
+			fmt.Println(a.Ref)
+		}
+		fmt.Fprintf(&stdin, "delete %s\n", a.Ref)
+	}
+	n := len(expired)
+	if n == 0 {
+		log.Printf("No failed attempts to delete")
+		return nil
+	}
+	if *dryRun {
+		log.Printf("Would delete %d attempts of %d runs", n, len(drop))
+		return nil
+	}
+	c := newCommand(cfg.Repo, "git", "update-ref", "--stdin")
+	c.Stdin = []byte(stdin.String())
+	if res, err := r.Run(ctx, c); err != nil {
+		return fmt.Errorf("git update-ref failed in %s: %w", cfg.Repo, outputError(err, res))
+	}
+	log.Printf("Deleted %d attempts of %d runs", n, len(drop))
+	return nil
+}
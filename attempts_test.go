@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestRefComponent(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"openrouter/x-ai/grok-code-fast-1", "openrouter-x-ai-grok-code-fast-1"},
+		{"ollama/qwen2.5-coder:7b", "ollama-qwen2.5-coder-7b"},
+		{"crates/cli:grep_cli", "crates-cli-grep_cli"},
+		{":root", "-root"},
+		{"a..b", "a-.b"},
+		{"a...b", "a--.b"},
+		{".hidden", "-.hidden"},
+		{"name.", "name.-"},
+		{"x.lock", "x.lock-"},
+		{"a b~c^d?e*f[g\\h@{i}", "a-b-c-d-e-f-g-h--i-"},
+		{"modèle", "mod-le"},
+		{"", "-"},
+	} {
+		if got := refComponent(tc.in); got != tc.want {
+			t.Errorf("refComponent(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAttemptRefIsValid(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	for _, c := range [][2]string{
+		{"openrouter/anthropic/claude-sonnet-4", "//crates/cli:grep_cli"},
+		{"ollama/qwen2.5-coder:7b", "//:root"},
+		{"../..", "//a/..:b.lock"},
+		{"m@{1}", "//x:y."},
+	} {
+		ref := attemptRef("20250908T120000Z", c[0], c[1], "3")
+		if out, err := exec.Command("git", "check-ref-format", ref).CombinedOutput(); err != nil {
+			t.Errorf("%s is not a valid ref: %v %s", ref, err, out)
+		}
+	}
+}
+
+func TestListSavedAttempts(t *testing.T) {
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		return &result{Stdout: []byte(
+			"refs/bld/20250908T120000Z/m/crates-a-a/1\x002025-09-08T12:01:00Z\x00aider: model m target //crates/a:a attempt 1: bazel build failed\n" +
+				"refs/bld/20250908T120000Z/m/crates-a-a/2-interrupted\x002025-09-08T12:02:00Z\x00aider: model m target //crates/a:a attempt 2-interrupted: bld was interrupted\n" +
+				"refs/bld/other\x002025-09-08T12:03:00Z\x00not bld's\n")}, nil
+	}}
+	attempts, err := listSavedAttempts(context.Background(), r, "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(attempts))
+	}
+	a := attempts[1]
+	if a.Run != "20250908T120000Z" || a.Model != "m" || a.Target != "crates-a-a" || a.Attempt != "2-interrupted" || a.Date != "2025-09-08T12:02:00Z" || a.name() != "20250908T120000Z/m/crates-a-a/2-interrupted" {
+		t.Errorf("got %+v", *a)
+	}
+}
+
+func TestExpiredAttempts(t *testing.T) {
+	var attempts []*savedAttempt
+	// Refs are listed by name, which for one run is not by time.
+	for _, run := range []string{"20250908T120000Z", "20250907T090000Z", "20250910T080000Z", "20250908T120000Z"} {
+		attempts = append(attempts, &savedAttempt{Ref: attemptRefPrefix + run + "/m/t/1", Run: run})
+	}
+	for _, tc := range []struct {
+		keep      int
+		wantRuns  []string
+		wantCount int
+	}{
+		{keep: 0, wantRuns: []string{"20250907T090000Z", "20250908T120000Z", "20250910T080000Z"}, wantCount: 4},
+		{keep: 1, wantRuns: []string{"20250907T090000Z", "20250908T120000Z"}, wantCount: 3},
+		{keep: 2, wantRuns: []string{"20250907T090000Z"}, wantCount: 1},
+		{keep: 3},
+		{keep: 10},
+	} {
+		expired, runs := expiredAttempts(attempts, tc.keep)
+		if !slices.Equal(runs, tc.wantRuns) || len(expired) != tc.wantCount {
+			t.Errorf("keep %d: %d attempts of runs %q expired, want %d of %q", tc.keep, len(expired), runs, tc.wantCount, tc.wantRuns)
+		}
+		for _, a := range expired {
+			if !slices.Contains(tc.wantRuns, a.Run) {
+				t.Errorf("keep %d: %s of a kept run expired", tc.keep, a.Ref)
+			}
+		}
+	}
+}
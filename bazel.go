@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// runBazelModExplain executes 'bazel mod explain' in the given directory.
+func runBazelModExplain(ctx context.Context, r runner, dir string) ([]byte, error) {
+	res, err := r.Run(ctx, newCommand(dir, "bazel", "mod", "explain"))
+	if err != nil {
+		return nil, fmt.Errorf("'bazel mod explain' failed: %w", outputError(err, res))
+	}
+	return res.Stdout, nil
+}
+
+// countQueryTargets returns the number of labels in 'bazel query' output.
+func countQueryTargets(queryOutput []byte) int {
+	if len(queryOutput) == 0 {
+		return 0
+	}
+	numTargets := len(bytes.Split(queryOutput, []byte("\n")))
+	if queryOutput[len(queryOutput)-1] == '\n' {
+		numTargets--
+	}
+	return numTargets
+}
+
+// newBazelQueryCommand returns the command running 'bazel query <query>' in dir.
+func newBazelQueryCommand(dir, query string) *command {
+	return newCommand(dir, "bazel", "query", query)
+}
+
+// newBazelBuildCommand returns the command running 'bazel build <query>' in dir.
+func newBazelBuildCommand(dir, query string) *command {
+	return newCommand(dir, "bazel", "build", query)
+}
+
+// runBazelQueryTarget executes 'bazel query <target>' in the given directory
+// and returns its combined output.
+func runBazelQueryTarget(ctx context.Context, r runner, dir string, target string) ([]byte, error) {
+	res, err := r.Run(ctx, newBazelQueryCommand(dir, target))
+	if err != nil {
+		return combinedOutput(res), fmt.Errorf("'bazel query' failed: %w", err)
+	}
+	return res.Combined, nil
+}
+
+// runBazelBuild executes 'bazel build <query>' in the given directory and
+// returns its combined output.
+func runBazelBuild(ctx context.Context, r runner, dir string, query string) ([]byte, error) {
+	res, err := r.Run(ctx, newBazelBuildCommand(dir, query))
+	if err != nil {
+		return combinedOutput(res), fmt.Errorf("'bazel build' failed: %w", err)
+	}
+	return res.Combined, nil
+}
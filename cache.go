@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// responseCache stores LLM replies on disk, keyed by a hash of the provider,
+// model, system prompt and input, so that repeating an identical request
+// costs nothing.
+type responseCache struct {
+	dir string
+	// refresh skips lookups but still stores replies.
+	refresh bool
+
+	hits, misses atomic.Int64
+}
+
+// cachedResponse is the content of a cache entry.
+type cachedResponse struct {
+	Provider  string     `json:"provider"`
+	Model     string     `json:"model"`
+	Content   string     `json:"content"`
+	Usage     *chatUsage `json:"usage,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// cacheKey returns the hex SHA-256 of the fields identifying a request.
+func cacheKey(provider string, req completionRequest) string {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(provider), []byte(req.Model), []byte(req.System), req.Input} {
+		// Length-prefix each field so that their boundaries are unambiguous.
+		binary.Write(h, binary.BigEndian, uint64(len(field)))
+		h.Write(field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// get returns the cached reply to req, or nil if there is none.
+func (c *responseCache) get(provider string, req completionRequest) (*cachedResponse, error) {
+	if c.refresh {
+		c.misses.Add(1)
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.path(cacheKey(provider, req)))
+	if errors.Is(err, os.ErrNotExist) {
+		c.misses.Add(1)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading LLM cache: %w", err)
+	}
+	var cr cachedResponse
+	if err := json.Unmarshal(data, &cr); err != nil {
+		// A corrupt entry is as good as none; it is overwritten by put.
+		c.misses.Add(1)
+		return nil, nil
+	}
+	c.hits.Add(1)
+	return &cr, nil
+}
+
+// put stores the reply to req atomically.
+func (c *responseCache) put(provider string, req completionRequest, comp *completion) error {
+	data, err := json.MarshalIndent(cachedResponse{
+		Provider:  provider,
+		Model:     req.Model,
+		Content:   comp.Content,
+		Usage:     comp.Usage,
+		CreatedAt: time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding LLM cache entry: %w", err)
+	}
+	path := c.path(cacheKey(provider, req))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating LLM cache dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error writing LLM cache entry: %w", err)
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing LLM cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing LLM cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing LLM cache entry: %w", err)
+	}
+	return nil
+}
+
+// complete returns the cached reply to req if there is one, and otherwise
+// asks p and caches its reply. A cached reply is written to req.Stream so
+// that callers see the same output either way, but has no usage: the tokens
+// it took were paid for, and counted, when it was first asked for.
+func (c *responseCache) complete(ctx context.Context, p llmProvider, provider string, req completionRequest) (*completion, error) {
+	cr, err := c.get(provider, req)
+	if err != nil {
+		return nil, err
+	}
+	if cr != nil {
+		loggerFrom(ctx).Printf("using cached reply of %s from %s", req.Model, cr.CreatedAt.Format(time.RFC3339))
+		if req.Stream != nil {
+			if _, err := io.WriteString(req.Stream, cr.Content); err != nil {
+				return nil, err
+			}
+		}
+		return &completion{Content: cr.Content}, nil
+	}
+	comp, err := p.complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.put(provider, req, comp); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// summary describes the cache's hits and misses, or is empty if the cache
+// was not used.
+func (c *responseCache) summary() string {
+	if c == nil {
+		return ""
+	}
+	hits, misses := c.hits.Load(), c.misses.Load()
+	if hits+misses == 0 {
+		return ""
+	}
+	return fmt.Sprintf("LLM cache: %d hits, %d misses (%s)", hits, misses, c.dir)
+}
+
+// cacheFlags control the response cache of a command.
+type cacheFlags struct {
+	noCache bool
+	refresh bool
+}
+
+// registerCacheFlags adds -no-cache and -refresh to fs.
+func registerCacheFlags(fs *flag.FlagSet) *cacheFlags {
+	f := &cacheFlags{}
+	fs.BoolVar(&f.noCache, "no-cache", false, "neither read nor write the LLM response cache")
+	fs.BoolVar(&f.refresh, "refresh", false, "ask the LLM again even if its reply is cached, and cache the new reply")
+	return f
+}
+
+// open returns the response cache of cfg, or nil if -no-cache was set.
+func (f *cacheFlags) open(cfg *config) (*responseCache, error) {
+	if f.noCache {
+		return nil, nil
+	}
+	dir, err := cfg.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &responseCache{dir: dir, refresh: f.refresh}, nil
+}
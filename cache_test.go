@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// fakeProvider replies with reply and counts its requests.
+type fakeProvider struct {
+	reply    string
+	usage    *chatUsage
+	requests int
+}
+
+func (p *fakeProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	p.requests++
+	if req.Stream != nil {
+		req.Stream.Write([]byte(p.reply))
+	}
+	return &completion{Content: p.reply, Usage: p.usage}, nil
+}
+
+func TestCacheKey(t *testing.T) {
+	req := completionRequest{Model: "m", System: "prompt", Input: []byte("input")}
+	key := cacheKey("openrouter", req)
+	if len(key) != 64 {
+		t.Errorf("key %q is not a hex SHA-256", key)
+	}
+	if cacheKey("openrouter", req) != key {
+		t.Error("key is not stable")
+	}
+	// The stream does not identify a request.
+	req.Stream = &strings.Builder{}
+	if cacheKey("openrouter", req) != key {
+		t.Error("key depends on the stream")
+	}
+	for name, other := range map[string]string{
+		"provider": cacheKey("ollama", req),
+		"model":    cacheKey("openrouter", completionRequest{Model: "n", System: "prompt", Input: []byte("input")}),
+		"system":   cacheKey("openrouter", completionRequest{Model: "m", System: "prompt2", Input: []byte("input")}),
+		"input":    cacheKey("openrouter", completionRequest{Model: "m", System: "prompt", Input: []byte("input2")}),
+		// Moving bytes between fields makes another request.
+		"boundary": cacheKey("openrouter", completionRequest{Model: "m", System: "promptinput"}),
+	} {
+		if other == key {
+			t.Errorf("%s: same key", name)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	ctx := context.Background()
+	cache := &responseCache{dir: t.TempDir()}
+	p := &fakeProvider{reply: "rust_library()", usage: &chatUsage{PromptTokens: 10, CompletionTokens: 2, Cost: 0.01}}
+	req := completionRequest{Model: "m", System: "prompt", Input: []byte("input")}
+
+	// A miss asks the provider and keeps its usage.
+	c, err := cache.complete(ctx, p, "openrouter", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.requests != 1 || c.Content != "rust_library()" || c.Usage == nil || c.Usage.Cost != 0.01 {
+		t.Errorf("miss: %d requests, %+v", p.requests, c)
+	}
+
+	// A hit does not, is streamed, and costs nothing.
+	var stream strings.Builder
+	req.Stream = &stream
+	c, err = cache.complete(ctx, p, "openrouter", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.requests != 1 || c.Content != "rust_library()" || c.Usage != nil {
+		t.Errorf("hit: %d requests, %+v", p.requests, c)
+	}
+	if stream.String() != "rust_library()" {
+		t.Errorf("streamed %q", stream.String())
+	}
+
+	// Another provider serving the same model is another request.
+	if _, err := cache.complete(ctx, p, "ollama", req); err != nil {
+		t.Fatal(err)
+	}
+	if p.requests != 2 {
+		t.Errorf("%d requests, want the other provider asked", p.requests)
+	}
+	if got, want := cache.summary(), "LLM cache: 1 hits, 2 misses"; !strings.HasPrefix(got, want) {
+		t.Errorf("summary = %q, want %q...", got, want)
+	}
+
+	// -refresh asks again and caches the new reply.
+	refresh := &responseCache{dir: cache.dir, refresh: true}
+	p.reply = "rust_binary()"
+	if c, err := refresh.complete(ctx, p, "openrouter", req); err != nil || c.Content != "rust_binary()" || p.requests != 3 {
+		t.Errorf("refresh: %d requests, %+v, %v", p.requests, c, err)
+	}
+	if c, err := cache.complete(ctx, p, "openrouter", req); err != nil || c.Content != "rust_binary()" || p.requests != 3 {
+		t.Errorf("after refresh: %d requests, %+v, %v", p.requests, c, err)
+	}
+}
+
+func TestCacheFlags(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CacheDir = t.TempDir()
+	for _, tc := range []struct {
+		args        []string
+		wantCache   bool
+		wantRefresh bool
+	}{
+		{args: nil, wantCache: true},
+		{args: []string{"-refresh"}, wantCache: true, wantRefresh: true},
+		{args: []string{"-no-cache"}},
+	} {
+		fs := newFlagSet("test")
+		f := registerCacheFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		cache, err := f.open(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (cache != nil) != tc.wantCache {
+			t.Fatalf("%q: cache = %v, want one: %v", tc.args, cache, tc.wantCache)
+		}
+		if cache != nil && (cache.dir != cfg.CacheDir || cache.refresh != tc.wantRefresh) {
+			t.Errorf("%q: cache in %s, refresh %v", tc.args, cache.dir, cache.refresh)
+		}
+	}
+	// Without a cache nothing is summarized.
+	var none *responseCache
+	if s := none.summary(); s != "" {
+		t.Errorf("summary of no cache = %q", s)
+	}
+}
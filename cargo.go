@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cargoMetadata is the subset of 'cargo metadata --format-version 1' output used by bld.
+type cargoMetadata struct {
+	Packages      []cargoPackage `json:"packages"`
+	WorkspaceRoot string         `json:"workspace_root"`
+}
+
+// cargoPackage is a package of a Cargo workspace.
+type cargoPackage struct {
+	Name         string            `json:"name"`
+	ManifestPath string            `json:"manifest_path"`
+	Targets      []cargoTarget     `json:"targets"`
+	Dependencies []cargoDependency `json:"dependencies"`
+}
+
+// cargoDependency is a dependency of a Cargo package.
+type cargoDependency struct {
+	Name string `json:"name"`
+	// Kind is "dev", "build" or empty for a normal dependency.
+	Kind string `json:"kind"`
+	// Path is the directory of a path dependency, such as another
+	// workspace member, and empty for dependencies from a registry.
+	Path string `json:"path"`
+}
+
+// cargoTarget is a library, binary, test, or other target of a Cargo package.
+type cargoTarget struct {
+	Name    string   `json:"name"`
+	Kind    []string `json:"kind"`
+	SrcPath string   `json:"src_path"`
+}
+
+// getCargoMetadata runs 'cargo metadata' for the workspace packages in dir and parses its output.
+func getCargoMetadata(ctx context.Context, r runner, dir string) (*cargoMetadata, error) {
+	res, err := r.Run(ctx, newCommand(dir, "cargo", "metadata", "--format-version", "1", "--no-deps"))
+	if err != nil {
+		return nil, fmt.Errorf("'cargo metadata' failed: %w", outputError(err, res))
+	}
+
+	var md cargoMetadata
+	if err := json.Unmarshal(res.Stdout, &md); err != nil {
+		return nil, fmt.Errorf("error parsing 'cargo metadata' output: %w", err)
+	}
+	return &md, nil
+}
+
+// getRustCrateNames returns a list of Rust crate names by running 'cargo metadata' and parsing its output.
+func getRustCrateNames(ctx context.Context, r runner, dir string) ([]string, error) {
+	md, err := getCargoMetadata(ctx, r, dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(md.Packages))
+	for _, pkg := range md.Packages {
+		result = append(result, pkg.Name)
+	}
+	return result, nil
+}
+
+// getRustCrateDependencies returns a list of dependency names for a given crate by running 'cargo tree'.
+func getRustCrateDependencies(ctx context.Context, r runner, dir string, crateName string) ([]string, error) {
+	res, err := r.Run(ctx, newCommand(dir, "cargo", "tree", "--package", crateName, "--prefix", "none"))
+	if err != nil {
+		return nil, fmt.Errorf("'cargo tree' failed for crate %s: %w", crateName, outputError(err, res))
+	}
+
+	// The output of `cargo tree --prefix none` lists each dependency on a new line.
+	lines := bytes.Split(bytes.TrimSpace(res.Stdout), []byte("\n"))
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if len(line) > 0 {
+			result = append(result, string(line))
+		}
+	}
+	return result, nil
+}
+
+// getCrateWithFewestDependencies returns the name of the crate with the fewest dependencies.
+func getCrateWithFewestDependencies(ctx context.Context, r runner, dir string) (string, error) {
+	crateNames, err := getRustCrateNames(ctx, r, dir)
+	if err != nil {
+		return "", fmt.Errorf("error getting Rust crate names: %w", err)
+	}
+
+	if len(crateNames) == 0 {
+		return "", nil // No crates found
+	}
+
+	minDependencies := -1
+	crateWithFewestDependencies := ""
+
+	for _, crateName := range crateNames {
+		dependencies, err := getRustCrateDependencies(ctx, r, dir, crateName)
+		if err != nil {
+			return "", fmt.Errorf("error getting dependencies for crate %s: %w", crateName, err)
+		}
+
+		numDependencies := len(dependencies)
+		if minDependencies == -1 || numDependencies < minDependencies {
+			minDependencies = numDependencies
+			crateWithFewestDependencies = crateName
+		}
+	}
+	return crateWithFewestDependencies, nil
+}
+
+// getCargoTomlPath returns the path to the Cargo.toml file for a given crate name.
+func getCargoTomlPath(ctx context.Context, r runner, dir string, crateName string) (string, error) {
+	md, err := getCargoMetadata(ctx, r, dir)
+	if err != nil {
+		return "", err
+	}
+	manifestPath := ""
+	for _, pkg := range md.Packages {
+		if pkg.Name == crateName {
+			manifestPath = pkg.ManifestPath
+			break
+		}
+	}
+	if manifestPath == "" {
+		return "", fmt.Errorf("Cargo.toml path not found for crate: %s", crateName)
+	}
+	relativePath, err := filepath.Rel(dir, manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("error getting relative path for %s: %w", manifestPath, err)
+	}
+	return relativePath, nil
+}
+
+// cargoTargetLabel returns the Bazel label bld expects for a Cargo target of
+// the package whose Cargo.toml is in pkgDir (relative to the workspace root).
+// Libraries are named after the crate with hyphens replaced, binaries keep
+// their name, and integration tests get a "_test" suffix. Other kinds, such
+// as examples, benches and build scripts, have no label.
+func cargoTargetLabel(pkgDir string, t cargoTarget) (string, bool) {
+	if pkgDir == "." {
+		pkgDir = ""
+	}
+	pkgDir = filepath.ToSlash(pkgDir)
+	for _, kind := range t.Kind {
+		switch kind {
+		case "lib", "rlib", "proc-macro":
+			return "//" + pkgDir + ":" + strings.ReplaceAll(t.Name, "-", "_"), true
+		case "bin":
+			return "//" + pkgDir + ":" + t.Name, true
+		case "test":
+			return "//" + pkgDir + ":" + strings.ReplaceAll(t.Name, "-", "_") + "_test", true
+		}
+	}
+	return "", false
+}
+
+// matchLabel reports whether label matches any of the path.Match patterns.
+func matchLabel(patterns []string, label string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, label); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverTargets derives the Bazel labels of the library, binary and test
+// targets of every workspace package in dir. When include is non-empty only
+// labels matching one of its patterns are kept; labels matching exclude are
+// dropped.
+func discoverTargets(ctx context.Context, r runner, dir string, include, exclude []string) ([]string, error) {
+	md, err := getCargoMetadata(ctx, r, dir)
+	if err != nil {
+		return nil, err
+	}
+	var labels []string
+	for _, pkg := range md.Packages {
+		pkgDir, err := filepath.Rel(md.WorkspaceRoot, filepath.Dir(pkg.ManifestPath))
+		if err != nil {
+			return nil, fmt.Errorf("error getting relative path for %s: %w", pkg.ManifestPath, err)
+		}
+		for _, t := range pkg.Targets {
+			label, ok := cargoTargetLabel(pkgDir, t)
+			if !ok {
+				continue
+			}
+			if len(include) > 0 && !matchLabel(include, label) {
+				continue
+			}
+			if matchLabel(exclude, label) {
+				continue
+			}
+			labels = append(labels, label)
+		}
+	}
+	loggerFrom(ctx).Printf("discovered %d targets in %s: %s", len(labels), dir, strings.Join(labels, " "))
+	return labels, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestCargoTargetLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		pkgDir string
+		target cargoTarget
+		want   string
+	}{
+		{name: "lib", pkgDir: "crates/grep-cli", target: cargoTarget{Name: "grep-cli", Kind: []string{"lib"}}, want: "//crates/grep-cli:grep_cli"},
+		{name: "rlib", pkgDir: "crates/a", target: cargoTarget{Name: "a", Kind: []string{"rlib", "cdylib"}}, want: "//crates/a:a"},
+		{name: "proc-macro", pkgDir: "macros", target: cargoTarget{Name: "my-derive", Kind: []string{"proc-macro"}}, want: "//macros:my_derive"},
+		{name: "bin keeps its name", pkgDir: "crates/core", target: cargoTarget{Name: "rg-cli", Kind: []string{"bin"}}, want: "//crates/core:rg-cli"},
+		{name: "test", pkgDir: "crates/a", target: cargoTarget{Name: "integration-tests", Kind: []string{"test"}}, want: "//crates/a:integration_tests_test"},
+		{name: "workspace root", pkgDir: ".", target: cargoTarget{Name: "rg", Kind: []string{"bin"}}, want: "//:rg"},
+		{name: "nested module", pkgDir: "crates/a/plugins/b", target: cargoTarget{Name: "b", Kind: []string{"lib"}}, want: "//crates/a/plugins/b:b"},
+		{name: "example", pkgDir: "crates/a", target: cargoTarget{Name: "demo", Kind: []string{"example"}}},
+		{name: "bench", pkgDir: "crates/a", target: cargoTarget{Name: "speed", Kind: []string{"bench"}}},
+		{name: "build script", pkgDir: "crates/a", target: cargoTarget{Name: "build-script-build", Kind: []string{"custom-build"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := cargoTargetLabel(tc.pkgDir, tc.target)
+			if got != tc.want || ok != (tc.want != "") {
+				t.Errorf("got %q, %v; want %q", got, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverTargets(t *testing.T) {
+	md, err := json.Marshal(cargoMetadata{
+		WorkspaceRoot: "/ws",
+		Packages: []cargoPackage{
+			{Name: "rg", ManifestPath: "/ws/Cargo.toml", Targets: []cargoTarget{
+				{Name: "rg", Kind: []string{"bin"}},
+				{Name: "integration", Kind: []string{"test"}},
+				{Name: "build-script-build", Kind: []string{"custom-build"}},
+			}},
+			{Name: "grep-cli", ManifestPath: "/ws/crates/cli/Cargo.toml", Targets: []cargoTarget{
+				{Name: "grep-cli", Kind: []string{"lib"}},
+			}},
+			{Name: "grep-pcre2", ManifestPath: "/ws/crates/cli/pcre2/Cargo.toml", Targets: []cargoTarget{
+				{Name: "grep-pcre2", Kind: []string{"lib"}},
+				{Name: "demo", Kind: []string{"example"}},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		return &result{Stdout: md}, nil
+	}}
+	for _, tc := range []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{
+			name: "all",
+			want: []string{"//:rg", "//:integration_test", "//crates/cli:grep_cli", "//crates/cli/pcre2:grep_pcre2"},
+		},
+		{
+			name:    "include",
+			include: []string{"//crates/*:*", "//:rg"},
+			want:    []string{"//:rg", "//crates/cli:grep_cli"},
+		},
+		{
+			name:    "exclude",
+			exclude: []string{"//*:*_test", "//crates/cli/*:*"},
+			want:    []string{"//:rg", "//crates/cli:grep_cli"},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"//crates/*:*", "//crates/*/*:*"},
+			exclude: []string{"//crates/cli:*"},
+			want:    []string{"//crates/cli/pcre2:grep_pcre2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := discoverTargets(context.Background(), r, "/ws", tc.include, tc.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+	if got := r.Commands[0].String(); got != "cargo metadata --format-version 1 --no-deps" {
+		t.Errorf("ran %s", got)
+	}
+}
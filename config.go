@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// defaultConfigFile is the config file loaded when -config is not given.
+const defaultConfigFile = "bld.toml"
+
+// config describes a bld run. It is read from a TOML file (see
+// bld.example.toml) and may be overridden from the command line.
+type config struct {
+	// Repo is the repository to migrate. Relative paths are resolved
+	// against the directory containing the config file.
+	Repo string `toml:"repo"`
+	// WorktreeDir is where per-model worktrees are created. A leading
+	// "~/" is expanded to the user's home directory.
+	WorktreeDir string `toml:"worktree_dir"`
+	// CacheDir holds cached LLM replies. A leading "~/" is expanded; empty
+	// means a "bld" directory under the user's cache directory.
+	CacheDir string `toml:"cache_dir"`
+	// MaxAttempts bounds the attempts per model and target, and the
+	// attempts of the migrator to repair its BUILD.bazel.
+	MaxAttempts int `toml:"max_attempts"`
+	// Model is the model used by single-model commands such as migrate.
+	Model string `toml:"model"`
+	// Models are the models compared by the matrix runner.
+	Models []string `toml:"models"`
+	// Agent is what edits the Bazel files in each attempt of the matrix
+	// runner: "aider", "native", bld's own tool-calling agent, or
+	// "oneshot", a single request whose reply is applied by bld.
+	Agent string `toml:"agent"`
+	// BudgetUSD caps what the matrix runner spends on each model in a run;
+	// once a model's spending reaches it, no new attempts are started for
+	// the model. Zero means no limit.
+	BudgetUSD float64 `toml:"budget_usd"`
+	// ContextBytes caps the size of the crate context sent to a model;
+	// see crateContext.
+	ContextBytes int `toml:"context_bytes"`
+	// Targets are the Bazel labels each model must make build.
+	Targets  []string       `toml:"targets"`
+	Discover discoverConfig `toml:"discover"`
+	Prompts  promptsConfig  `toml:"prompts"`
+	Policy   policyConfig   `toml:"policy"`
+	// Providers are the LLM backends, by name; see resolveProvider for
+	// how models are matched to them.
+	Providers map[string]providerConfig `toml:"providers"`
+	// DefaultProvider serves models whose name has no provider prefix.
+	DefaultProvider string `toml:"default_provider"`
+	// Timeouts bound each run of a program, keyed by its name ("aider",
+	// "bazel", "llm", "git", "cargo"); "llm" bounds every request to a
+	// provider. Zero means no timeout.
+	Timeouts map[string]time.Duration `toml:"timeouts"`
+	Retry    retryConfig              `toml:"retry"`
+}
+
+// discoverConfig controls deriving targets from 'cargo metadata'.
+type discoverConfig struct {
+	// Enabled adds the discovered labels to Targets.
+	Enabled bool `toml:"enabled"`
+	// Include and Exclude are path.Match patterns over labels, such as
+	// "//crates/*:*" or "//*:*_test".
+	Include []string `toml:"include"`
+	Exclude []string `toml:"exclude"`
+}
+
+// providerConfig describes an LLM backend.
+type providerConfig struct {
+	// Type is "openai" (the default), "ollama" or "llm".
+	Type string `toml:"type"`
+	// BaseURL is the root of the API of "openai" and "ollama" providers.
+	BaseURL string `toml:"base_url"`
+	// APIKeyEnv names the environment variable holding the API key of an
+	// "openai" provider. The key is not sent if the variable is unset or
+	// empty.
+	APIKeyEnv string `toml:"api_key_env"`
+	// RequestsPerMinute spaces out the requests to the provider, and the
+	// aider runs of models it serves, to at most this many a minute. Zero
+	// means no limit.
+	RequestsPerMinute float64 `toml:"requests_per_minute"`
+}
+
+// retryConfig controls retrying the transient failures of providers and
+// aider; see retry.
+type retryConfig struct {
+	// MaxRetries bounds the retries of each request or aider run. Zero
+	// disables retrying.
+	MaxRetries int `toml:"max_retries"`
+	// InitialDelay is the longest wait before the first retry. It doubles
+	// with each retry up to MaxDelay.
+	InitialDelay time.Duration `toml:"initial_delay"`
+	MaxDelay     time.Duration `toml:"max_delay"`
+}
+
+// promptsConfig selects the prompt templates; see loadPrompts.
+type promptsConfig struct {
+	// Variant names the set of templates to use, such as "default" or
+	// "rules_rust".
+	Variant string `toml:"variant"`
+	// Dir holds prompt variants besides the built-in ones, one directory
+	// of templates per variant. Relative paths are resolved against the
+	// directory containing the config file.
+	Dir string `toml:"dir"`
+}
+
+// defaultConfig returns the configuration used for keys a config file leaves unset.
+func defaultConfig() *config {
+	return &config{
+		WorktreeDir:  "~/worktree",
+		MaxAttempts:  5,
+		ContextBytes: 32 << 10,
+		Model:        "openrouter/google/gemini-2.5-flash",
+		Agent:        agentAider,
+		Providers: map[string]providerConfig{
+			"openrouter": {Type: providerOpenAI, BaseURL: "https://openrouter.ai/api/v1", APIKeyEnv: "OPENROUTER_API_KEY"},
+			"ollama":     {Type: providerOllama, BaseURL: "http://localhost:11434"},
+			"llm":        {Type: providerLLM},
+		},
+		DefaultProvider: "openrouter",
+		Timeouts: map[string]time.Duration{
+			"aider": 30 * time.Minute,
+			"bazel": 30 * time.Minute,
+			"llm":   10 * time.Minute,
+			"git":   2 * time.Minute,
+			"cargo": 10 * time.Minute,
+		},
+		Retry: retryConfig{MaxRetries: 4, InitialDelay: 2 * time.Second, MaxDelay: time.Minute},
+		Prompts: promptsConfig{
+			Variant: "default",
+		},
+		Policy: policyConfig{
+			AllowedFiles: []string{"BUILD", "BUILD.bazel", "MODULE.bazel", "MODULE.bazel.lock", "*.bzl", ".bazelrc"},
+			OnViolation:  policyReject,
+		},
+	}
+}
+
+// configError reports an invalid configuration value. Key names the
+// offending TOML key, or the flag that overrode it.
+type configError struct {
+	File string
+	Key  string
+	Msg  string
+}
+
+func (e *configError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%s: %s", e.Key, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.File, e.Key, e.Msg)
+}
+
+// loadConfig reads the TOML file at path over the defaults. A missing file
+// is only an error when mustExist is set.
+func loadConfig(path string, mustExist bool) (*config, error) {
+	cfg := defaultConfig()
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) && !mustExist {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("%s: %s", path, perr.ErrorWithPosition())
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, &configError{File: path, Key: undecoded[0].String(), Msg: "unknown key"}
+	}
+	mergeProviderDefaults(md, cfg.Providers)
+	if cfg.Repo != "" && !filepath.IsAbs(cfg.Repo) {
+		cfg.Repo = filepath.Join(filepath.Dir(path), cfg.Repo)
+	}
+	if cfg.Prompts.Dir != "" && !filepath.IsAbs(cfg.Prompts.Dir) {
+		cfg.Prompts.Dir = filepath.Join(filepath.Dir(path), cfg.Prompts.Dir)
+	}
+	return cfg, nil
+}
+
+// mergeProviderDefaults fills in the keys a config file leaves unset in its
+// tables of the built-in providers. Decoding replaces a provider as a whole,
+// so that [providers.openrouter] with only requests_per_minute would
+// otherwise lose the type and base_url of OpenRouter.
+func mergeProviderDefaults(md toml.MetaData, providers map[string]providerConfig) {
+	for name, def := range defaultConfig().Providers {
+		p, ok := providers[name]
+		if !ok || !md.IsDefined("providers", name) {
+			continue
+		}
+		if !md.IsDefined("providers", name, "type") {
+			p.Type = def.Type
+		}
+		if !md.IsDefined("providers", name, "base_url") {
+			p.BaseURL = def.BaseURL
+		}
+		if !md.IsDefined("providers", name, "api_key_env") {
+			p.APIKeyEnv = def.APIKeyEnv
+		}
+		if !md.IsDefined("providers", name, "requests_per_minute") {
+			p.RequestsPerMinute = def.RequestsPerMinute
+		}
+		providers[name] = p
+	}
+}
+
+// validate checks the values every command relies on. file is used to
+// prefix errors and may be empty.
+func (c *config) validate(file string) error {
+	if c.MaxAttempts < 1 {
+		return &configError{File: file, Key: "max_attempts", Msg: "must be at least 1"}
+	}
+	if c.WorktreeDir == "" {
+		return &configError{File: file, Key: "worktree_dir", Msg: "must not be empty"}
+	}
+	if c.Model == "" {
+		return &configError{File: file, Key: "model", Msg: "must not be empty"}
+	}
+	if c.Agent != agentAider && c.Agent != agentNative && c.Agent != agentOneShot {
+		return &configError{File: file, Key: "agent", Msg: fmt.Sprintf("unknown agent %q; want aider, native or oneshot", c.Agent)}
+	}
+	if v := c.Prompts.Variant; v == "" || v == "." || v == ".." || strings.ContainsAny(v, `/\`) {
+		return &configError{File: file, Key: "prompts.variant", Msg: fmt.Sprintf("%q is not a variant name", v)}
+	} else if variants := promptVariants(c); !slices.Contains(variants, v) {
+		return &configError{File: file, Key: "prompts.variant", Msg: fmt.Sprintf("unknown variant %q; have %s", v, strings.Join(variants, ", "))}
+	}
+	if c.BudgetUSD < 0 {
+		return &configError{File: file, Key: "budget_usd", Msg: "must not be negative"}
+	}
+	if c.ContextBytes < minContextBytes {
+		return &configError{File: file, Key: "context_bytes", Msg: fmt.Sprintf("must be at least %d", minContextBytes)}
+	}
+	seen := make(map[string]bool)
+	for i, m := range c.Models {
+		key := fmt.Sprintf("models[%d]", i)
+		if m == "" {
+			return &configError{File: file, Key: key, Msg: "must not be empty"}
+		}
+		if seen[m] {
+			return &configError{File: file, Key: key, Msg: fmt.Sprintf("duplicate model %q", m)}
+		}
+		seen[m] = true
+	}
+	seen = make(map[string]bool)
+	for i, t := range c.Targets {
+		key := fmt.Sprintf("targets[%d]", i)
+		if !strings.HasPrefix(t, "//") {
+			return &configError{File: file, Key: key, Msg: fmt.Sprintf("%q is not an absolute Bazel label", t)}
+		}
+		if seen[t] {
+			return &configError{File: file, Key: key, Msg: fmt.Sprintf("duplicate target %q", t)}
+		}
+		seen[t] = true
+	}
+	for name, p := range c.Providers {
+		switch p.Type {
+		case providerOpenAI, providerOllama, "":
+			if u, err := url.Parse(p.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return &configError{File: file, Key: "providers." + name + ".base_url", Msg: fmt.Sprintf("%q is not an http or https URL", p.BaseURL)}
+			}
+		case providerLLM:
+		default:
+			return &configError{File: file, Key: "providers." + name + ".type", Msg: fmt.Sprintf("unknown type %q; want openai, ollama or llm", p.Type)}
+		}
+		if p.RequestsPerMinute < 0 {
+			return &configError{File: file, Key: "providers." + name + ".requests_per_minute", Msg: "must not be negative"}
+		}
+	}
+	if _, ok := c.Providers[c.DefaultProvider]; !ok {
+		return &configError{File: file, Key: "default_provider", Msg: fmt.Sprintf("no provider named %q", c.DefaultProvider)}
+	}
+	for name, t := range c.Timeouts {
+		if t < 0 {
+			return &configError{File: file, Key: "timeouts." + name, Msg: "must not be negative"}
+		}
+	}
+	if c.Retry.MaxRetries < 0 {
+		return &configError{File: file, Key: "retry.max_retries", Msg: "must not be negative"}
+	}
+	if c.Retry.InitialDelay <= 0 {
+		return &configError{File: file, Key: "retry.initial_delay", Msg: "must be positive"}
+	}
+	if c.Retry.MaxDelay < c.Retry.InitialDelay {
+		return &configError{File: file, Key: "retry.max_delay", Msg: "must not be less than retry.initial_delay"}
+	}
+	for i, p := range c.Policy.AllowedFiles {
+		if _, err := path.Match(p, ""); err != nil {
+			return &configError{File: file, Key: fmt.Sprintf("policy.allowed_files[%d]", i), Msg: fmt.Sprintf("bad pattern %q", p)}
+		}
+	}
+	if c.Policy.OnViolation != policyReject && c.Policy.OnViolation != policyRevert {
+		return &configError{File: file, Key: "policy.on_violation", Msg: fmt.Sprintf("unknown action %q; want reject or revert", c.Policy.OnViolation)}
+	}
+	for i, p := range c.Discover.Include {
+		if _, err := path.Match(p, ""); err != nil {
+			return &configError{File: file, Key: fmt.Sprintf("discover.include[%d]", i), Msg: fmt.Sprintf("bad pattern %q", p)}
+		}
+	}
+	for i, p := range c.Discover.Exclude {
+		if _, err := path.Match(p, ""); err != nil {
+			return &configError{File: file, Key: fmt.Sprintf("discover.exclude[%d]", i), Msg: fmt.Sprintf("bad pattern %q", p)}
+		}
+	}
+	return nil
+}
+
+// worktreeBaseDir returns WorktreeDir with a leading "~/" expanded.
+func (c *config) worktreeBaseDir() (string, error) {
+	return expandHome(c.WorktreeDir)
+}
+
+// cacheDir returns the directory of the LLM response cache.
+func (c *config) cacheDir() (string, error) {
+	if c.CacheDir != "" {
+		return expandHome(c.CacheDir)
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting user cache directory: %w", err)
+	}
+	return filepath.Join(dir, "bld"), nil
+}
+
+// expandHome expands a leading "~/" in p to the user's home directory.
+func expandHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(p, "~")), nil
+}
+
+// listFlag is a comma-separated list flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// configFlags are the command-line overrides of config keys.
+type configFlags struct {
+	path        string
+	repo        string
+	worktreeDir string
+	maxAttempts int
+	model       string
+	models      listFlag
+	targets     listFlag
+	discover    bool
+	variant     string
+	agent       string
+}
+
+// register adds the config flags to fs.
+func (f *configFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.path, "config", defaultConfigFile, "TOML file describing the run")
+	fs.StringVar(&f.repo, "wd", "", "working directory of the repository to migrate (overrides repo; default $PWD)")
+	fs.StringVar(&f.worktreeDir, "worktree-dir", "", "base directory of per-model worktrees (overrides worktree_dir)")
+	fs.IntVar(&f.maxAttempts, "max-attempts", 0, "attempts per model and target (overrides max_attempts)")
+	fs.StringVar(&f.model, "model", "", "LLM model for single-model commands (overrides model)")
+	fs.Var(&f.models, "models", "comma-separated models to compare (overrides models)")
+	fs.Var(&f.targets, "targets", "comma-separated Bazel targets (overrides targets)")
+	fs.BoolVar(&f.discover, "discover", false, "add targets discovered with cargo metadata (overrides discover.enabled)")
+	fs.StringVar(&f.variant, "prompt-variant", "", "prompt templates to use (overrides prompts.variant)")
+	fs.StringVar(&f.agent, "agent", "", "what edits Bazel files in matrix attempts: aider, native or oneshot (overrides agent)")
+}
+
+// load reads the config file and applies the flags that were set on fs.
+func (f *configFlags) load(fs *flag.FlagSet) (*config, error) {
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	cfg, err := loadConfig(f.path, set["config"])
+	if err != nil {
+		return nil, err
+	}
+	if set["wd"] {
+		cfg.Repo = f.repo
+	}
+	if cfg.Repo == "" {
+		cfg.Repo = os.Getenv("PWD")
+		if cfg.Repo == "" {
+			cfg.Repo = "."
+		}
+	}
+	// cargo reports absolute paths, which are made relative to Repo.
+	if cfg.Repo, err = filepath.Abs(cfg.Repo); err != nil {
+		return nil, fmt.Errorf("error resolving the repository path: %w", err)
+	}
+	if set["worktree-dir"] {
+		cfg.WorktreeDir = f.worktreeDir
+	}
+	if set["max-attempts"] {
+		cfg.MaxAttempts = f.maxAttempts
+	}
+	if set["model"] {
+		cfg.Model = f.model
+	}
+	if set["models"] {
+		cfg.Models = f.models
+	}
+	if set["targets"] {
+		cfg.Targets = f.targets
+	}
+	if set["discover"] {
+		cfg.Discover.Enabled = f.discover
+	}
+	if set["prompt-variant"] {
+		cfg.Prompts.Variant = f.variant
+	}
+	if set["agent"] {
+		cfg.Agent = f.agent
+	}
+
+	file := ""
+	if _, err := os.Stat(f.path); err == nil {
+		file = f.path
+	}
+	if err := cfg.validate(file); err != nil {
+		// Point at the flag rather than the file when the flag supplied the value.
+		var cerr *configError
+		if errors.As(err, &cerr) {
+			key, _, _ := strings.Cut(cerr.Key, "[")
+			if name := overrideFlags[key]; set[name] {
+				cerr.File, cerr.Key = "", "-"+name
+			}
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// overrideFlags maps config keys to the flags that override them.
+var overrideFlags = map[string]string{
+	"repo":            "wd",
+	"worktree_dir":    "worktree-dir",
+	"max_attempts":    "max-attempts",
+	"model":           "model",
+	"models":          "models",
+	"targets":         "targets",
+	"prompts.variant": "prompt-variant",
+	"agent":           "agent",
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bld.toml")
+	toml := `
+[providers.openrouter]
+requests_per_minute = 30
+
+[providers.ollama]
+base_url = "http://gpu:11434"
+
+[providers.local]
+type = "openai"
+base_url = "http://localhost:8080/v1"
+`
+	if err := os.WriteFile(path, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]providerConfig{
+		"openrouter": {Type: providerOpenAI, BaseURL: "https://openrouter.ai/api/v1", APIKeyEnv: "OPENROUTER_API_KEY", RequestsPerMinute: 30},
+		"ollama":     {Type: providerOllama, BaseURL: "http://gpu:11434"},
+		"llm":        {Type: providerLLM},
+		"local":      {Type: providerOpenAI, BaseURL: "http://localhost:8080/v1"},
+	}
+	for name, p := range want {
+		if got := cfg.Providers[name]; got != p {
+			t.Errorf("providers.%s = %+v, want %+v", name, got, p)
+		}
+	}
+
+	// New providers get no defaults, and the missing key is reported.
+	if err := os.WriteFile(path, []byte("[providers.local]\ntype = \"openai\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cerr *configError
+	if err := cfg.validate(path); !errors.As(err, &cerr) || cerr.Key != "providers.local.base_url" {
+		t.Errorf("err = %v, want providers.local.base_url reported", err)
+	}
+}
+
+func TestConfigFlagsRelativeRepo(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile("bld.toml", []byte("repo = \"ws\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-config", "bld.toml"}, want: filepath.Join(dir, "ws")},
+		{args: []string{"-config", "bld.toml", "-wd", "path/to/repo"}, want: filepath.Join(dir, "path", "to", "repo")},
+		{args: []string{"-config", "bld.toml", "-wd", "."}, want: dir},
+	} {
+		fs := newFlagSet("test")
+		common := registerCommonFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := common.load(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Repo != tc.want {
+			t.Errorf("%q: repo = %s, want %s", tc.args, cfg.Repo, tc.want)
+		}
+	}
+}
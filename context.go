@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// minContextBytes is the smallest context_bytes accepted.
+const minContextBytes = 4 << 10
+
+// contextSection is a titled part of a crate's context, such as a file.
+type contextSection struct {
+	title   string
+	content string
+}
+
+// crateContext describes the crate in pkgDir, relative to the workspace root
+// dir, for a model asked to write its BUILD.bazel. It holds, most important
+// first:
+//
+//   - MODULE.bazel and the crate's Cargo.toml
+//   - the crate_universe repository external crates are taken from
+//   - the crate's library, binary, test and other targets, as Cargo sees
+//     them, including those it infers from the source layout
+//   - build.rs
+//   - the crate's files
+//   - the BUILD files of the workspace crates it depends on
+//
+// The context is cut to at most maxBytes, truncating or dropping the least
+// important sections first.
+func crateContext(ctx context.Context, r runner, dir, pkgDir string, maxBytes int) (string, error) {
+	md, err := getCargoMetadata(ctx, r, dir)
+	if err != nil {
+		return "", err
+	}
+	pkg, err := packageInDir(md, pkgDir)
+	if err != nil {
+		return "", err
+	}
+
+	var sections []contextSection
+	addFile := func(rel string) error {
+		content, err := os.ReadFile(filepath.Join(dir, rel))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", rel, err)
+		}
+		sections = append(sections, contextSection{filepath.ToSlash(rel), string(content)})
+		return nil
+	}
+
+	if err := addFile("MODULE.bazel"); err != nil {
+		return "", err
+	}
+	if err := addFile(filepath.Join(pkgDir, "Cargo.toml")); err != nil {
+		return "", err
+	}
+	if len(sections) > 0 && sections[0].title == "MODULE.bazel" {
+		if repos := crateUniverseRepos([]byte(sections[0].content)); len(repos) > 0 {
+			sections = append(sections, contextSection{"crate_universe", fmt.Sprintf("External crates are in @%s, e.g. @%s//:serde.\n", strings.Join(repos, ", @"), repos[0])})
+		}
+	}
+	var buildScript string
+	var targets strings.Builder
+	for _, t := range pkg.Targets {
+		rel, err := filepath.Rel(filepath.Dir(pkg.ManifestPath), t.SrcPath)
+		if err != nil {
+			rel = t.SrcPath
+		}
+		if slices.Contains(t.Kind, "custom-build") {
+			buildScript = filepath.Join(pkgDir, rel)
+		}
+		fmt.Fprintln(&targets, cargoTargetSection(t, filepath.ToSlash(rel)))
+	}
+	sections = append(sections, contextSection{"Cargo targets of " + pkg.Name, targets.String()})
+	if buildScript != "" {
+		if err := addFile(buildScript); err != nil {
+			return "", err
+		}
+	}
+
+	files, err := gitListFiles(ctx, r, dir, pkgDir)
+	if err != nil {
+		return "", err
+	}
+	// Leave out the files of packages nested in pkgDir, such as the members
+	// of a workspace whose root is a package too.
+	var nested []string
+	for _, p := range md.Packages {
+		rel, err := filepath.Rel(md.WorkspaceRoot, filepath.Dir(p.ManifestPath))
+		if err == nil && p.ManifestPath != pkg.ManifestPath {
+			nested = append(nested, filepath.ToSlash(rel)+"/")
+		}
+	}
+	var tree []string
+	for _, f := range files {
+		if !slices.ContainsFunc(nested, func(dir string) bool { return strings.HasPrefix(f, dir) }) {
+			tree = append(tree, strings.TrimPrefix(f, filepath.ToSlash(pkgDir)+"/"))
+		}
+	}
+	slices.Sort(tree)
+	sections = append(sections, contextSection{"files in " + filepath.ToSlash(pkgDir), strings.Join(tree, "\n") + "\n"})
+
+	for _, dep := range pkg.Dependencies {
+		if dep.Path == "" {
+			continue
+		}
+		depDir, err := filepath.Rel(md.WorkspaceRoot, dep.Path)
+		if err != nil || depDir == ".." || strings.HasPrefix(depDir, ".."+string(filepath.Separator)) {
+			continue // not in the workspace
+		}
+		for _, name := range []string{"BUILD.bazel", "BUILD"} {
+			n := len(sections)
+			if err := addFile(filepath.Join(depDir, name)); err != nil {
+				return "", err
+			}
+			if len(sections) > n {
+				break
+			}
+		}
+	}
+
+	s, dropped := renderContext(sections, maxBytes)
+	if len(dropped) > 0 {
+		loggerFrom(ctx).Printf("Context for %s is over %d bytes; cut %s", pkg.Name, maxBytes, strings.Join(dropped, ", "))
+	}
+	return s, nil
+}
+
+// cargoTargetSection describes a Cargo target like the Cargo.toml section
+// declaring it, such as `[[bin]] name = "rg", path = "src/main.rs"`, whether
+// or not it is declared or inferred by Cargo.
+func cargoTargetSection(t cargoTarget, srcPath string) string {
+	section := "[lib]"
+	extra := ""
+	for _, kind := range t.Kind {
+		switch kind {
+		case "bin", "test", "example", "bench":
+			section = "[[" + kind + "]]"
+		case "custom-build":
+			section = "[package] build ="
+			return fmt.Sprintf("%s %q", section, srcPath)
+		case "proc-macro":
+			extra = ", proc-macro = true"
+		}
+	}
+	return fmt.Sprintf("%s name = %q, path = %q%s", section, t.Name, srcPath, extra)
+}
+
+// packageInDir returns the package of md whose Cargo.toml is in pkgDir.
+func packageInDir(md *cargoMetadata, pkgDir string) (*cargoPackage, error) {
+	for i, pkg := range md.Packages {
+		rel, err := filepath.Rel(md.WorkspaceRoot, filepath.Dir(pkg.ManifestPath))
+		if err == nil && rel == filepath.Clean(pkgDir) {
+			return &md.Packages[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no Cargo package in %s", pkgDir)
+}
+
+// renderContext joins sections in the format bld has always fed to models,
+// "--- title ---" followed by the content, within maxBytes. The first
+// section that does not fit is truncated if enough of it fits to be useful;
+// it and those after it are otherwise left out. renderContext returns the
+// titles of the sections cut.
+func renderContext(sections []contextSection, maxBytes int) (string, []string) {
+	const (
+		truncated = "... (truncated)\n"
+		minUseful = 512
+	)
+	var b bytes.Buffer
+	var cut []string
+	for _, s := range sections {
+		header := fmt.Sprintf("--- %s ---\n", s.title)
+		content := strings.TrimRight(s.content, "\n") + "\n\n"
+		if len(cut) > 0 {
+			cut = append(cut, s.title)
+			continue
+		}
+		room := maxBytes - b.Len() - len(header)
+		if len(content) > room {
+			cut = append(cut, s.title)
+			room -= len(truncated)
+			if room < minUseful {
+				continue
+			}
+			// Cut at a line boundary.
+			content = content[:room]
+			if i := strings.LastIndexByte(content, '\n'); i >= 0 {
+				content = content[:i+1]
+			}
+			content += truncated
+		}
+		b.WriteString(header)
+		b.WriteString(content)
+	}
+	return b.String(), cut
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCrateContext(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"MODULE.bazel":                 "bazel_dep(name = \"rules_rust\", version = \"0.64.0\")\n\ncrate = use_extension(\"@rules_rust//crate_universe:extensions.bzl\", \"crate\")\ncrate.from_cargo(name = \"deps\", cargo_lockfile = \"//:Cargo.lock\")\n",
+		"crates/cli/Cargo.toml":        "[package]\nname = \"grep-cli\"\n",
+		"crates/cli/build.rs":          "fn main() {}\n",
+		"crates/cli/src/lib.rs":        "",
+		"crates/cli/plugin/Cargo.toml": "[package]\nname = \"plugin\"\n",
+		"crates/core/BUILD.bazel":      "rust_library(name = \"core\")\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	md, err := json.Marshal(cargoMetadata{
+		WorkspaceRoot: dir,
+		Packages: []cargoPackage{
+			{
+				Name:         "grep-cli",
+				ManifestPath: filepath.Join(dir, "crates/cli/Cargo.toml"),
+				Targets: []cargoTarget{
+					{Name: "grep_cli", Kind: []string{"lib"}, SrcPath: filepath.Join(dir, "crates/cli/src/lib.rs")},
+					{Name: "build-script-build", Kind: []string{"custom-build"}, SrcPath: filepath.Join(dir, "crates/cli/build.rs")},
+				},
+				Dependencies: []cargoDependency{
+					{Name: "grep-core", Path: filepath.Join(dir, "crates/core")},
+					{Name: "outside", Path: filepath.Join(filepath.Dir(dir), "outside")},
+					{Name: "serde"},
+				},
+			},
+			{Name: "plugin", ManifestPath: filepath.Join(dir, "crates/cli/plugin/Cargo.toml")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		if c.Name == "cargo" {
+			return &result{Stdout: md}, nil
+		}
+		return &result{Stdout: []byte("crates/cli/Cargo.toml\ncrates/cli/build.rs\ncrates/cli/src/lib.rs\ncrates/cli/plugin/Cargo.toml\n")}, nil
+	}}
+	got, err := crateContext(context.Background(), r, dir, "crates/cli", 32<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- MODULE.bazel ---\n" + files["MODULE.bazel"] + "\n" +
+		"--- crates/cli/Cargo.toml ---\n" + files["crates/cli/Cargo.toml"] + "\n" +
+		"--- crate_universe ---\nExternal crates are in @deps, e.g. @deps//:serde.\n\n" +
+		"--- Cargo targets of grep-cli ---\n[lib] name = \"grep_cli\", path = \"src/lib.rs\"\n[package] build = \"build.rs\"\n\n" +
+		"--- crates/cli/build.rs ---\n" + files["crates/cli/build.rs"] + "\n" +
+		// The nested package's files are left out.
+		"--- files in crates/cli ---\nCargo.toml\nbuild.rs\nsrc/lib.rs\n\n" +
+		// So are dependencies outside the workspace.
+		"--- crates/core/BUILD.bazel ---\n" + files["crates/core/BUILD.bazel"] + "\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := crateContext(context.Background(), r, dir, "crates/none", 32<<10); err == nil {
+		t.Error("described a directory without a package")
+	}
+}
+
+func TestRenderContext(t *testing.T) {
+	long := strings.Repeat("0123456789abcdef\n", 64) // 1088 bytes
+	sections := []contextSection{
+		{"MODULE.bazel", "module(name = \"m\")\n"},
+		{"files", long},
+		{"crates/core/BUILD.bazel", "rust_library(name = \"core\")"},
+	}
+	full := "--- MODULE.bazel ---\nmodule(name = \"m\")\n\n--- files ---\n" + long + "\n--- crates/core/BUILD.bazel ---\nrust_library(name = \"core\")\n\n"
+	for _, tc := range []struct {
+		name     string
+		maxBytes int
+		wantCut  []string
+		check    func(t *testing.T, s string)
+	}{
+		{
+			name:     "fits",
+			maxBytes: len(full),
+			check: func(t *testing.T, s string) {
+				if s != full {
+					t.Errorf("got\n%s\nwant\n%s", s, full)
+				}
+			},
+		},
+		{
+			name:     "truncated",
+			maxBytes: 700,
+			wantCut:  []string{"files", "crates/core/BUILD.bazel"},
+			check: func(t *testing.T, s string) {
+				if len(s) > 700 || !strings.HasSuffix(s, "0123456789abcdef\n... (truncated)\n") {
+					t.Errorf("%d bytes ending %q", len(s), s[max(0, len(s)-40):])
+				}
+			},
+		},
+		{
+			name:     "too little room to be useful",
+			maxBytes: 300,
+			wantCut:  []string{"files", "crates/core/BUILD.bazel"},
+			check: func(t *testing.T, s string) {
+				if s != "--- MODULE.bazel ---\nmodule(name = \"m\")\n\n" {
+					t.Errorf("got %q", s)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, cut := renderContext(sections, tc.maxBytes)
+			if !slices.Equal(cut, tc.wantCut) {
+				t.Errorf("cut %q, want %q", cut, tc.wantCut)
+			}
+			tc.check(t, s)
+		})
+	}
+}
+
+func TestCrateUniverseRepos(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		module string
+		want   []string
+	}{
+		{
+			name:   "default name",
+			module: "crate = use_extension(\"@rules_rust//crate_universe:extensions.bzl\", \"crate\")\ncrate.from_cargo(cargo_lockfile = \"//:Cargo.lock\")\nuse_repo(crate, \"crates\")\n",
+			want:   []string{"crates"},
+		},
+		{
+			name:   "named repositories",
+			module: "c = use_extension(\"@rules_rust//crate_universe:extensions.bzl\", \"crate\")\nc.from_cargo(name = \"deps\")\nc.from_specs(name = \"tools\")\nc.from_cargo(name = \"deps\")\n",
+			want:   []string{"deps", "tools"},
+		},
+		{
+			name:   "other extensions",
+			module: "rust = use_extension(\"@rules_rust//rust:extensions.bzl\", \"rust\")\nrust.toolchain(edition = \"2021\")\n",
+		},
+		{
+			name:   "does not parse",
+			module: "crate = use_extension(\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := crateUniverseRepos([]byte(tc.module)); !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// runEnsemble asks every model in cfg.Models for the crate's files, up to
+// jobs models at a time, each in a worktree of its own detached at the HEAD
+// of wd, and commits to wd the smallest candidate that builds, naming its
+// model in the commit message. The worktrees are removed when it returns.
+func (mg *crateMigration) runEnsemble(ctx context.Context, wd string, jobs int) error {
+	cfg, r := mg.cfg, mg.r
+	if len(cfg.Models) == 0 {
+		return &configError{Key: "models", Msg: "must not be empty with -ensemble"}
+	}
+	worktreeBaseDir, err := cfg.worktreeBaseDir()
+	if err != nil {
+		return err
+	}
+	branch, err := getGitBranch(ctx, r, wd)
+	if err != nil {
+		return fmt.Errorf("error getting git branch: %w", err)
+	}
+
+	worktrees := make([]string, 0, len(cfg.Models))
+	defer func() {
+		// Clean up even if bld was interrupted.
+		ctx := context.WithoutCancel(ctx)
+		for _, p := range worktrees {
+			if err := removeGitWorktree(ctx, r, wd, p); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+	for _, model := range cfg.Models {
+		p := filepath.Join(worktreeBaseDir, branch+"-ensemble-"+sanitizePath(model))
+		// A worktree left behind by a run that was killed.
+		if exists, err := gitWorktreeExists(p); err != nil {
+			return err
+		} else if exists {
+			if err := removeGitWorktree(ctx, r, wd, p); err != nil {
+				return err
+			}
+		}
+		if err := addDetachedGitWorktree(ctx, r, wd, p); err != nil {
+			return err
+		}
+		worktrees = append(worktrees, p)
+	}
+
+	candidates := make([]*migrationCandidate, len(cfg.Models))
+	errs := make([]error, len(cfg.Models))
+	var g errgroup.Group
+	g.SetLimit(jobs)
+	for i, model := range cfg.Models {
+		g.Go(func() error {
+			logger := log.New(log.Writer(), "["+model+"] ", log.Flags()|log.Lmsgprefix)
+			out := newLineWriter(logger)
+			c, err := mg.run(withLogger(ctx, logger), model, worktrees[i], out)
+			out.flush()
+			if err != nil {
+				logger.Printf("No candidate: %v", err)
+				errs[i] = fmt.Errorf("model %s: %w", model, err)
+				return nil
+			}
+			logger.Printf("Candidate builds: %s, %d bytes", describeFiles(c.files), c.size())
+			candidates[i] = c
+			return nil
+		})
+	}
+	g.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The smallest candidate wins; ties go to the model listed first.
+	var best *migrationCandidate
+	var notes []string
+	for i, c := range candidates {
+		if c == nil {
+			notes = append(notes, fmt.Sprintf("- %s: failed", cfg.Models[i]))
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("- %s: %d bytes", c.model, c.size()))
+		if best == nil || c.size() < best.size() {
+			best = c
+		}
+	}
+	if best == nil {
+		return fmt.Errorf("no model wrote a BUILD.bazel that builds crate %s: %w", mg.crate, errors.Join(errs...))
+	}
+	log.Printf("Keeping the %d-byte candidate of %s", best.size(), best.model)
+
+	paths, err := writeBazelFiles(wd, best.files)
+	if err != nil {
+		return err
+	}
+	msg := migrateCommitMessage(mg.crate, best.model, "Candidates:\n"+strings.Join(notes, "\n"))
+	if err := gitCommitPaths(ctx, r, filepath.Join(wd, mg.pkgDir), msg, paths...); err != nil {
+		return fmt.Errorf("error committing BUILD.bazel file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// getGitHead returns the commit checked out in dir.
+func getGitHead(ctx context.Context, r runner, dir string) (string, error) {
+	res, err := r.Run(ctx, newCommand(dir, "git", "rev-parse", "HEAD"))
+	if err != nil {
+		return "", fmt.Errorf("failed to get git HEAD: %w", err)
+	}
+	return strings.TrimSpace(string(res.Stdout)), nil
+}
+
+// getGitBranch returns the current git branch name for a given directory.
+func getGitBranch(ctx context.Context, r runner, dir string) (string, error) {
+	res, err := r.Run(ctx, newCommand(dir, "git", "rev-parse", "--abbrev-ref", "HEAD"))
+	if err != nil {
+		return "", fmt.Errorf("failed to get git branch: %w", err)
+	}
+	return strings.TrimSpace(string(res.Stdout)), nil
+}
+
+// gitBranchExists checks if a git branch exists.
+func gitBranchExists(ctx context.Context, r runner, dir, branchName string) (bool, error) {
+	res, err := r.Run(ctx, newCommand(dir, "git", "show-ref", "--verify", "--quiet", "refs/heads/"+branchName))
+	if err != nil {
+		if res != nil && res.ExitCode == 1 {
+			return false, nil // Branch does not exist
+		}
+		return false, fmt.Errorf("failed to check if branch %s exists: %w", branchName, err)
+	}
+	return true, nil // Branch exists
+}
+
+// newGitBranchCommand returns the command creating branchName in dir.
+func newGitBranchCommand(dir, branchName string) *command {
+	return newCommand(dir, "git", "branch", branchName)
+}
+
+// createGitBranch creates a new git branch.
+func createGitBranch(ctx context.Context, r runner, dir, branchName string) error {
+	if res, err := r.Run(ctx, newGitBranchCommand(dir, branchName)); err != nil {
+		return fmt.Errorf("failed to create branch %s: %w", branchName, outputError(err, res))
+	}
+	return nil
+}
+
+// createGitBranchIfNotExists ensures the given branch exists in the repo at dir.
+// If the branch does not exist it will be created. The function logs progress
+// similarly to the previous inline behavior.
+func createGitBranchIfNotExists(ctx context.Context, r runner, dir, branchName string) error {
+	exists, err := gitBranchExists(ctx, r, dir, branchName)
+	if err != nil {
+		return fmt.Errorf("failed to check if branch %s exists: %w", branchName, err)
+	}
+	if exists {
+		loggerFrom(ctx).Printf("Branch %s already exists.", branchName)
+		return nil
+	}
+
+	loggerFrom(ctx).Printf("Branch %s does not exist, creating...", branchName)
+	if err := createGitBranch(ctx, r, dir, branchName); err != nil {
+		return fmt.Errorf("failed to create branch %s: %w", branchName, err)
+	}
+	loggerFrom(ctx).Printf("Branch %s created.", branchName)
+	return nil
+}
+
+// gitWorktreeExists checks if a git worktree exists at the given path.
+func gitWorktreeExists(worktreePath string) (bool, error) {
+	_, err := os.Stat(worktreePath)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check worktree existence at %s: %w", worktreePath, err)
+}
+
+// newGitWorktreeAddCommand returns the command adding a worktree of branchName at worktreePath.
+func newGitWorktreeAddCommand(repoDir, worktreePath, branchName string) *command {
+	return newCommand(repoDir, "git", "worktree", "add", worktreePath, branchName)
+}
+
+// addGitWorktree adds a new git worktree.
+func addGitWorktree(ctx context.Context, r runner, repoDir, worktreePath, branchName string) error {
+	if res, err := r.Run(ctx, newGitWorktreeAddCommand(repoDir, worktreePath, branchName)); err != nil {
+		return fmt.Errorf("failed to add worktree at %s for branch %s: %w", worktreePath, branchName, outputError(err, res))
+	}
+	return nil
+}
+
+// bazelSymlinksPattern matches the convenience symlinks, such as bazel-bin
+// and bazel-out, that bazel creates in the workspace root.
+const bazelSymlinksPattern = "/bazel-*"
+
+// gitExcludeBazelSymlinks adds bazelSymlinksPattern to the info/exclude file
+// of the repo of the worktree at dir unless it is there, so that 'git add -A'
+// and 'git ls-files --others' leave bazel's outputs alone.
+func gitExcludeBazelSymlinks(ctx context.Context, r runner, dir string) error {
+	res, err := r.Run(ctx, newCommand(dir, "git", "rev-parse", "--git-path", "info/exclude"))
+	if err != nil {
+		return fmt.Errorf("failed to find the exclude file of %s: %w", dir, outputError(err, res))
+	}
+	exclude := strings.TrimSpace(string(res.Stdout))
+	if !filepath.IsAbs(exclude) {
+		exclude = filepath.Join(dir, exclude)
+	}
+	data, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading %s: %w", exclude, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == bazelSymlinksPattern {
+			return nil
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	data = append(data, bazelSymlinksPattern+"\n"...)
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return fmt.Errorf("error creating dir for %s: %w", exclude, err)
+	}
+	if err := os.WriteFile(exclude, data, 0644); err != nil {
+		return fmt.Errorf("error writing %s: %w", exclude, err)
+	}
+	return nil
+}
+
+// addDetachedGitWorktree adds a worktree at worktreePath whose HEAD is
+// detached at the HEAD of repoDir.
+func addDetachedGitWorktree(ctx context.Context, r runner, repoDir, worktreePath string) error {
+	if res, err := r.Run(ctx, newCommand(repoDir, "git", "worktree", "add", "--detach", worktreePath, "HEAD")); err != nil {
+		return fmt.Errorf("failed to add worktree at %s: %w", worktreePath, outputError(err, res))
+	}
+	return nil
+}
+
+// removeGitWorktree removes the worktree at worktreePath, discarding its
+// changes.
+func removeGitWorktree(ctx context.Context, r runner, repoDir, worktreePath string) error {
+	if res, err := r.Run(ctx, newCommand(repoDir, "git", "worktree", "remove", "--force", worktreePath)); err != nil {
+		return fmt.Errorf("failed to remove worktree at %s: %w", worktreePath, outputError(err, res))
+	}
+	return nil
+}
+
+// createGitWorktreeIfNotExists ensures the given worktree exists at worktreePath.
+// If the worktree does not exist it will be created. The function logs progress
+// similarly to the previous inline behavior.
+func createGitWorktreeIfNotExists(ctx context.Context, r runner, repoDir, worktreePath, branchName string) error {
+	exists, err := gitWorktreeExists(worktreePath)
+	if err != nil {
+		return fmt.Errorf("failed to check if worktree %s exists: %w", worktreePath, err)
+	}
+	if exists {
+		loggerFrom(ctx).Printf("Worktree already exists at: %s", worktreePath)
+		return nil
+	}
+
+	loggerFrom(ctx).Printf("Worktree at %s does not exist, creating...", worktreePath)
+	if err := addGitWorktree(ctx, r, repoDir, worktreePath, branchName); err != nil {
+		return fmt.Errorf("failed to add worktree at %s for branch %s: %w", worktreePath, branchName, err)
+	}
+	loggerFrom(ctx).Printf("Worktree created at: %s", worktreePath)
+	return nil
+}
+
+// gitSaveWorktree commits the worktree at dir, untracked but not ignored
+// files included, on top of HEAD with message and points ref at the commit.
+// The worktree, its index and its branch are left alone. It reports false
+// without updating ref when the worktree has no changes.
+func gitSaveWorktree(ctx context.Context, r runner, dir, ref, message string) (bool, error) {
+	tmp, err := os.MkdirTemp("", "bld-index-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	git := func(args ...string) (string, error) {
+		c := newCommand(dir, "git", args...)
+		c.Env = []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+		res, err := r.Run(ctx, c)
+		if err != nil {
+			return "", fmt.Errorf("git %s failed in %s: %w", args[0], dir, outputError(err, res))
+		}
+		return strings.TrimSpace(string(res.Stdout)), nil
+	}
+	if _, err := git("read-tree", "HEAD"); err != nil {
+		return false, err
+	}
+	if _, err := git("add", "-A"); err != nil {
+		return false, err
+	}
+	tree, err := git("write-tree")
+	if err != nil {
+		return false, err
+	}
+	headTree, err := git("rev-parse", "HEAD^{tree}")
+	if err != nil {
+		return false, err
+	}
+	if tree == headTree {
+		return false, nil
+	}
+	commit, err := git("commit-tree", tree, "-p", "HEAD", "-m", message)
+	if err != nil {
+		return false, err
+	}
+	if res, err := r.Run(ctx, newGitUpdateRefCommand(dir, ref, commit)); err != nil {
+		return false, fmt.Errorf("git update-ref failed in %s: %w", dir, outputError(err, res))
+	}
+	return true, nil
+}
+
+// newGitUpdateRefCommand returns the command pointing ref at rev in the repo at dir.
+func newGitUpdateRefCommand(dir, ref, rev string) *command {
+	return newCommand(dir, "git", "update-ref", ref, rev)
+}
+
+// newGitDiscardCommands returns the commands discarding the changes of the
+// worktree at dir, untracked but not ignored files included.
+func newGitDiscardCommands(dir string) []*command {
+	return []*command{
+		newCommand(dir, "git", "reset", "-q", "--hard"),
+		newCommand(dir, "git", "clean", "-fdq"),
+	}
+}
+
+// gitDiscardChanges resets the worktree at dir to its HEAD and removes its
+// untracked files so the next attempt starts clean.
+func gitDiscardChanges(ctx context.Context, r runner, dir string) error {
+	for _, c := range newGitDiscardCommands(dir) {
+		if res, err := r.Run(ctx, c); err != nil {
+			return fmt.Errorf("git %s failed in %s: %w", c.Args[0], dir, outputError(err, res))
+		}
+	}
+	return nil
+}
+
+// gitCommitPaths adds the given paths in dir and commits them with message.
+func gitCommitPaths(ctx context.Context, r runner, dir, message string, paths ...string) error {
+	addArgs := append([]string{"add"}, paths...)
+	if res, err := r.Run(ctx, newCommand(dir, "git", addArgs...)); err != nil {
+		return fmt.Errorf("error adding %s to git: %w", strings.Join(paths, " and "), outputError(err, res))
+	}
+	if res, err := r.Run(ctx, newGitCommitCommand(dir, message)); err != nil {
+		return fmt.Errorf("error committing %s: %w", strings.Join(paths, " and "), outputError(err, res))
+	}
+	loggerFrom(ctx).Printf("%s committed successfully.\n", strings.Join(paths, " and "))
+	return nil
+}
+
+// newGitCommitCommand returns the command committing the index in dir with message.
+func newGitCommitCommand(dir, message string) *command {
+	return newCommand(dir, "git", "commit", "-m", message)
+}
+
+// gitFileExists reports whether path exists in the tree of rev in the repo at dir.
+func gitFileExists(ctx context.Context, r runner, dir, rev, path string) (bool, error) {
+	res, err := r.Run(ctx, newCommand(dir, "git", "cat-file", "-e", rev+":"+filepath.ToSlash(path)))
+	if err != nil {
+		if res != nil && res.ExitCode == 128 {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check if %s exists at %s: %w", path, rev, err)
+	}
+	return true, nil
+}
+
+// gitCommitAll adds every untracked or dirty file in dir and commits them with
+// message. It reports false without committing when there is nothing to commit.
+func gitCommitAll(ctx context.Context, r runner, dir, message string) (bool, error) {
+	if res, err := r.Run(ctx, newCommand(dir, "git", "add", "-A")); err != nil {
+		return false, fmt.Errorf("git add failed in %s: %w", dir, outputError(err, res))
+	}
+
+	statusRes, err := r.Run(ctx, newCommand(dir, "git", "status", "--porcelain"))
+	if err != nil {
+		return false, fmt.Errorf("git status failed in %s: %w", dir, err)
+	}
+	if strings.TrimSpace(string(statusRes.Stdout)) == "" {
+		return false, nil
+	}
+
+	// Log git's summary of the commit like the rest of the job's log.
+	out := newLineWriter(loggerFrom(ctx))
+	commitCmd := newGitCommitCommand(dir, message)
+	commitCmd.Stdout, commitCmd.Stderr = out, out
+	res, err := r.Run(ctx, commitCmd)
+	out.flush()
+	if err != nil {
+		return false, fmt.Errorf("git commit failed in %s: %w", dir, outputError(err, res))
+	}
+	return true, nil
+}
+
+// gitChangedSince returns the files of the worktree at dir that differ from
+// rev, whether the change is committed or not, and the untracked files that
+// are not ignored, relative to dir.
+func gitChangedSince(ctx context.Context, r runner, dir, rev string) ([]string, error) {
+	var files []string
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--no-renames", "-z", rev, "--"},
+		{"ls-files", "--others", "--exclude-standard", "-z"},
+	} {
+		res, err := r.Run(ctx, newCommand(dir, "git", args...))
+		if err != nil {
+			return nil, fmt.Errorf("git %s failed in %s: %w", args[0], dir, outputError(err, res))
+		}
+		for _, f := range strings.Split(string(res.Stdout), "\x00") {
+			if f != "" && !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// gitRestoreFiles restores files in the worktree at dir to their content at
+// rev, removing those rev does not have.
+func gitRestoreFiles(ctx context.Context, r runner, dir, rev string, files []string) error {
+	for _, f := range files {
+		exists, err := gitFileExists(ctx, r, dir, rev, f)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := os.RemoveAll(filepath.Join(dir, f)); err != nil {
+				return fmt.Errorf("error removing %s: %w", f, err)
+			}
+			continue
+		}
+		if res, err := r.Run(ctx, newCommand(dir, "git", "checkout", rev, "--", f)); err != nil {
+			return fmt.Errorf("git checkout failed in %s: %w", dir, outputError(err, res))
+		}
+	}
+	return nil
+}
+
+// gitResetSoft moves the branch checked out in dir back to rev, leaving the
+// changes of the commits after it staged.
+func gitResetSoft(ctx context.Context, r runner, dir, rev string) error {
+	if res, err := r.Run(ctx, newCommand(dir, "git", "reset", "-q", "--soft", rev)); err != nil {
+		return fmt.Errorf("git reset failed in %s: %w", dir, outputError(err, res))
+	}
+	return nil
+}
+
+// gitListFiles returns the files under pkgDir in the worktree at dir that are
+// tracked or untracked but not ignored, relative to dir.
+func gitListFiles(ctx context.Context, r runner, dir, pkgDir string) ([]string, error) {
+	res, err := r.Run(ctx, newCommand(dir, "git", "ls-files", "--cached", "--others", "--exclude-standard", "--", pkgDir))
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files failed in %s: %w", dir, outputError(err, res))
+	}
+	var files []string
+	for _, line := range strings.Split(string(res.Stdout), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// gitDiffAll returns the changes of the worktree at dir against HEAD,
+// untracked but not ignored files included. It stages the changes in a
+// temporary index, leaving the worktree's own index alone.
+func gitDiffAll(ctx context.Context, r runner, dir string) ([]byte, error) {
+	tmp, err := os.MkdirTemp("", "bld-index-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+	var res *result
+	for _, args := range [][]string{
+		{"read-tree", "HEAD"},
+		{"add", "-A"},
+		{"diff", "--cached", "--binary", "HEAD"},
+	} {
+		c := newCommand(dir, "git", args...)
+		c.Env = env
+		if res, err = r.Run(ctx, c); err != nil {
+			return nil, fmt.Errorf("git %s failed in %s: %w", args[0], dir, outputError(err, res))
+		}
+	}
+	return res.Stdout, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGitBranchExists(t *testing.T) {
+	for _, tc := range []struct {
+		code    int
+		want    bool
+		wantErr bool
+	}{
+		{code: 0, want: true},
+		{code: 1, want: false},
+		{code: 128, wantErr: true},
+	} {
+		r := &recordingRunner{Respond: func(c *command) (*result, error) {
+			if tc.code != 0 {
+				return exitError(tc.code)
+			}
+			return &result{}, nil
+		}}
+		got, err := gitBranchExists(context.Background(), r, "/repo", "main-m")
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("exit code %d: got %v, %v; want %v, error %v", tc.code, got, err, tc.want, tc.wantErr)
+		}
+		if c := r.Commands[0]; c.Dir != "/repo" || c.String() != "git show-ref --verify --quiet refs/heads/main-m" {
+			t.Errorf("ran %s in %s", c, c.Dir)
+		}
+	}
+}
+
+func TestGitFileExists(t *testing.T) {
+	for _, tc := range []struct {
+		code    int
+		want    bool
+		wantErr bool
+	}{
+		{code: 0, want: true},
+		{code: 128, want: false},
+		{code: 1, wantErr: true},
+	} {
+		r := &recordingRunner{Respond: func(c *command) (*result, error) {
+			if tc.code != 0 {
+				return exitError(tc.code)
+			}
+			return &result{}, nil
+		}}
+		got, err := gitFileExists(context.Background(), r, "/repo", "main", "a/BUILD.bazel")
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("exit code %d: got %v, %v; want %v, error %v", tc.code, got, err, tc.want, tc.wantErr)
+		}
+		if got := r.Commands[0].String(); got != "git cat-file -e main:a/BUILD.bazel" {
+			t.Errorf("ran %s", got)
+		}
+	}
+}
+
+func TestGitChangedSince(t *testing.T) {
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		if c.Args[0] == "diff" {
+			return &result{Stdout: []byte("a/BUILD.bazel\x00src/with space.rs\x00")}, nil
+		}
+		return &result{Stdout: []byte("a/BUILD.bazel\x00notes.txt\x00")}, nil
+	}}
+	got, err := gitChangedSince(context.Background(), r, "/wt", "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/BUILD.bazel", "src/with space.rs", "notes.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if c := r.Commands[0]; !slices.Contains(c.Args, "abc123") {
+		t.Errorf("diff %q does not compare with the base", c.Args)
+	}
+}
+
+func TestGitSaveWorktree(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		headTree string
+		want     bool
+	}{
+		{name: "changed", headTree: "tree0", want: true},
+		{name: "unchanged", headTree: "tree1", want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &recordingRunner{Respond: func(c *command) (*result, error) {
+				switch c.Args[0] {
+				case "write-tree":
+					return &result{Stdout: []byte("tree1\n")}, nil
+				case "rev-parse":
+					return &result{Stdout: []byte(tc.headTree + "\n")}, nil
+				case "commit-tree":
+					return &result{Stdout: []byte("commit1\n")}, nil
+				}
+				return &result{}, nil
+			}}
+			got, err := gitSaveWorktree(context.Background(), r, "/wt", "refs/bld/run/m/t/1", "failed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			var ran []string
+			for _, c := range r.Commands {
+				ran = append(ran, c.Args[0])
+				// Only update-ref may touch more than the temporary index.
+				if c.Args[0] != "update-ref" && (len(c.Env) != 1 || !strings.HasPrefix(c.Env[0], "GIT_INDEX_FILE=")) {
+					t.Errorf("git %s does not use a temporary index: %q", c.Args[0], c.Env)
+				}
+			}
+			want := []string{"read-tree", "add", "write-tree", "rev-parse"}
+			if tc.want {
+				want = append(want, "commit-tree", "update-ref")
+			}
+			if !slices.Equal(ran, want) {
+				t.Errorf("ran git %q, want %q", ran, want)
+			}
+			if tc.want {
+				if got := r.Commands[len(r.Commands)-1].String(); got != "git update-ref refs/bld/run/m/t/1 commit1" {
+					t.Errorf("ran %s", got)
+				}
+			}
+		})
+	}
+}
+
+func TestGitExcludeBazelSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	exclude := filepath.Join(dir, "info", "exclude")
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		return &result{Stdout: []byte(exclude + "\n")}, nil
+	}}
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(exclude, []byte("# git ls-files --others --exclude-from=.git/info/exclude\n*.swp"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The pattern is added once however often the worktree is set up.
+	for range 2 {
+		if err := gitExcludeBazelSymlinks(context.Background(), r, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# git ls-files --others --exclude-from=.git/info/exclude\n*.swp\n/bazel-*\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGitCommitAllLogs(t *testing.T) {
+	var buf strings.Builder
+	ctx := withLogger(context.Background(), log.New(&buf, "[m] ", log.Lmsgprefix))
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		switch c.Args[0] {
+		case "status":
+			return &result{Stdout: []byte(" M BUILD.bazel\n")}, nil
+		case "commit":
+			if c.Stdout == nil {
+				t.Fatal("git commit output is not captured")
+			}
+			io.WriteString(c.Stdout, "[main-m 1234567] aider: model m\n 1 file changed\n")
+		}
+		return &result{}, nil
+	}}
+	committed, err := gitCommitAll(ctx, r, "/wt", "aider: model m")
+	if err != nil || !committed {
+		t.Fatalf("got %v, %v; want a commit", committed, err)
+	}
+	if want := "[m] [main-m 1234567] aider: model m\n[m]  1 file changed\n"; buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+}
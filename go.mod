@@ -1,3 +1,9 @@
-module migrate
+module github.com/dan-stowell/bld
 
 go 1.24.2
+
+require github.com/BurntSushi/toml v1.5.0
+
+require golang.org/x/sync v0.16.0
+
+require github.com/bazelbuild/buildtools v0.0.0-20260904073137-eaa4d125b423
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// invokeLLM sends prompt as the system prompt and input as the user message
+// to model and returns its reply and usage. The reply is streamed to stream as it
+// arrives unless stream is nil; a marker separates a partial reply from the
+// retry that replaces it. Replies are looked up in and added to cache
+// unless it is nil. Transient failures are retried as configured by
+// cfg.Retry, and the "llm" timeout bounds each request.
+func invokeLLM(ctx context.Context, r runner, cfg *config, cache *responseCache, prompt, model string, input []byte, stream io.Writer) (*completion, error) {
+	p, provider, name, err := resolveProvider(r, cfg, model)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting provider of %s: %w", model, err)
+	}
+	logger := loggerFrom(ctx)
+	logger.Printf("asking %s", model)
+	req := completionRequest{Model: name, System: prompt, Input: input}
+	var sw *streamWriter
+	if stream != nil {
+		sw = &streamWriter{w: stream}
+		req.Stream = sw
+	}
+	var c *completion
+	retries, err := retry(ctx, cfg.Retry, "request to "+model, isTransientLLMError, func() error {
+		if sw != nil && sw.written {
+			// The reply starts over; say so rather than let the partial
+			// reply run into the new one.
+			fmt.Fprintf(stream, "\n[request to %s failed; retrying, the reply starts over]\n", model)
+			sw.written = false
+		}
+		ctx := ctx
+		if t := cfg.Timeouts["llm"]; t > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
+		}
+		var err error
+		if cache != nil {
+			c, err = cache.complete(ctx, p, provider, req)
+		} else {
+			c, err = p.complete(ctx, req)
+		}
+		return err
+	})
+	if err != nil {
+		if retries > 0 {
+			return nil, fmt.Errorf("request to %s failed after %d retries: %w", model, retries, err)
+		}
+		return nil, fmt.Errorf("request to %s failed: %w", model, err)
+	}
+	c.Retries = retries
+	if u := c.Usage; u != nil {
+		logger.Printf("%s used %d prompt and %d completion tokens ($%.4f)", model, u.PromptTokens, u.CompletionTokens, u.Cost)
+	}
+	return c, nil
+}
+
+// streamWriter passes a streamed reply on to w, noting whether any of it was
+// written.
+type streamWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		sw.written = true
+	}
+	return sw.w.Write(p)
+}
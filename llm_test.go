@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvokeLLMRetryAfterPartialStream(t *testing.T) {
+	withJitter(t, func(n time.Duration) time.Duration { return 0 })
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if requests.Add(1) == 1 {
+			// Part of a reply, then an error worth retrying.
+			fmt.Fprint(w, "data: {\"id\":\"x\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"par\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"error\":{\"message\":\"Provider overloaded\",\"code\":502}}\n\n")
+			return
+		}
+		fmt.Fprint(w, "data: {\"id\":\"y\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"whole\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	cfg := defaultConfig()
+	cfg.Providers["test"] = providerConfig{Type: providerOpenAI, BaseURL: srv.URL}
+	cfg.DefaultProvider = "test"
+	cfg.Retry = retryConfig{MaxRetries: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	var stream strings.Builder
+	c, err := invokeLLM(context.Background(), &recordingRunner{}, cfg, nil, "prompt", "m", []byte("input"), &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Content != "whole" || c.Retries != 1 {
+		t.Errorf("reply %q after %d retries, want whole after 1", c.Content, c.Retries)
+	}
+	want := "par\n[request to m failed; retrying, the reply starts over]\nwhole"
+	if stream.String() != want {
+		t.Errorf("streamed %q, want %q", stream.String(), want)
+	}
+}
+
+func TestInvokeLLMRetryBeforeStream(t *testing.T) {
+	withJitter(t, func(n time.Duration) time.Duration { return 0 })
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, `{"error":{"message":"unavailable"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "data: {\"id\":\"y\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"whole\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	cfg := defaultConfig()
+	cfg.Providers["test"] = providerConfig{Type: providerOpenAI, BaseURL: srv.URL}
+	cfg.DefaultProvider = "test"
+	cfg.Retry = retryConfig{MaxRetries: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	var stream strings.Builder
+	if _, err := invokeLLM(context.Background(), &recordingRunner{}, cfg, nil, "prompt", "m", []byte("input"), &stream); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing was streamed before the retry, so there is nothing to mark.
+	if stream.String() != "whole" {
+		t.Errorf("streamed %q, want whole", stream.String())
+	}
+}
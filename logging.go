@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+)
+
+type loggerKey struct{}
+
+// withLogger returns a context whose helpers log to l.
+func withLogger(ctx context.Context, l *log.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger of ctx, or the standard logger if it has none.
+// Helpers that may run concurrently log through it so that every line carries
+// the prefix of the job it belongs to.
+func loggerFrom(ctx context.Context) *log.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*log.Logger); ok {
+		return l
+	}
+	return log.Default()
+}
+
+// lineWriter logs each line written to it. Call flush to log a trailing
+// partial line.
+type lineWriter struct {
+	mu  sync.Mutex
+	l   *log.Logger
+	buf []byte
+}
+
+func newLineWriter(l *log.Logger) *lineWriter {
+	return &lineWriter{l: l}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.l.Print(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.l.Print(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// sanitizePath replaces characters that are unsafe in file paths with hyphens.
+func sanitizePath(s string) string {
+	s = strings.ReplaceAll(s, "/", "-")
+	s = strings.ReplaceAll(s, ":", "-")
+	return s
+}
+
+// runLLM asks model for the BUILD.bazel of the crate under targetDir, feeding
+// input (typically the crate's crateContext and its current Bazel files) to
+// the model. The model may answer with whole files or with edits, which are
+// applied to the files of the worktree at dir; see replyFiles. runLLM
+// returns the files of the reply, which may include MODULE.bazel, formatted,
+// the system prompt and the reply. The reply is returned even if it is
+// unusable, does not apply or does not parse.
+func runLLM(ctx context.Context, r runner, cfg *config, prompts *promptSet, cache *responseCache, model, dir, targetDir, previousError, input string) ([]bazelFile, string, *completion, error) {
+	prompt, err := prompts.render(promptBuildFile, promptData{PackageDir: targetDir, PreviousError: previousError})
+	if err != nil {
+		return nil, "", nil, err
+	}
+	prompt += "\n\n" + editFormatsPrompt
+	c, err := invokeLLM(ctx, r, cfg, cache, prompt, model, []byte(input), nil)
+	if err != nil {
+		return nil, prompt, nil, err
+	}
+	files, err := replyFiles(dir, c.Content, path.Join(filepath.ToSlash(targetDir), "BUILD.bazel"))
+	if err == nil {
+		err = formatBazelFiles(files)
+	}
+	return files, prompt, c, err
+}
+
+// targetBuildFile returns the path of the BUILD.bazel file of target's
+// package relative to the workspace root, e.g. "crates/cli/BUILD.bazel" for
+// "//crates/cli:grep_cli". It reports false for labels that are not
+// package-style, such as external repository labels.
+func targetBuildFile(target string) (string, bool) {
+	// Parse target like //path/to/pkg:target or //:target
+	if !strings.HasPrefix(target, "//") {
+		return "", false
+	}
+	pkg := strings.TrimPrefix(target, "//")
+	if idx := strings.Index(pkg, ":"); idx != -1 {
+		pkg = pkg[:idx]
+	}
+	return filepath.Join(pkg, "BUILD.bazel"), true
+}
+
+// placeholderBuildFile is the content of the BUILD.bazel files written by
+// ensureBuildBazelExists so that aider has a file to edit.
+const placeholderBuildFile = "# created by bld.go\n"
+
+// ensureBuildBazelExists writes a placeholder BUILD.bazel in the package of
+// target if it has none, returning the path of the file it wrote, or "" if
+// it wrote none.
+func ensureBuildBazelExists(ctx context.Context, worktreePath, target string) (string, error) {
+	buildFile, ok := targetBuildFile(target)
+	if !ok {
+		// not a package-style target; nothing to do
+		return "", nil
+	}
+	buildPath := filepath.Join(worktreePath, buildFile)
+	if _, err := os.Stat(buildPath); err == nil {
+		return "", nil
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to stat %s: %w", buildPath, err)
+	}
+	dir := filepath.Dir(buildPath)
+	if dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create dir %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(buildPath, []byte(placeholderBuildFile), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", buildPath, err)
+	}
+	loggerFrom(ctx).Printf("Created %s", buildPath)
+	return buildPath, nil
+}
+
+// modelWorktree returns the branch and worktree path used for model when
+// the repository is on branch.
+func modelWorktree(branch, worktreeBaseDir, model string) (modelBranch, worktreePath string) {
+	modelBranch = branch + "-" + sanitizePath(model)
+	return modelBranch, filepath.Join(worktreeBaseDir, modelBranch)
+}
+
+// matrixCommitMessage is the message of the commit recording the successful
+// changes agent made for target with model.
+func matrixCommitMessage(agent, model, target string) string {
+	return fmt.Sprintf("%s: model %s target %s", agent, model, target)
+}
+
+// newAiderCommand returns the aider invocation sending message to model to
+// make target build, editing MODULE.bazel and buildFile in worktreePath. Its
+// output is streamed to bld's own stdout and stderr.
+func newAiderCommand(worktreePath, model, target, buildFile, message string) *command {
+	c := newCommand(worktreePath,
+		"aider",
+		"--disable-playwright",
+		"--yes-always",
+		"--model", model,
+		"--edit-format", "diff",
+		"--auto-test",
+		"--test-cmd", "bazel build "+target,
+		"--message", message,
+		"MODULE.bazel",
+		buildFile,
+	)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c
+}
+
+// resolveTargets returns the configured targets followed by any discovered
+// from cargo metadata that are not already listed.
+func resolveTargets(ctx context.Context, r runner, cfg *config) ([]string, error) {
+	if !cfg.Discover.Enabled {
+		return cfg.Targets, nil
+	}
+	discovered, err := discoverTargets(ctx, r, cfg.Repo, cfg.Discover.Include, cfg.Discover.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering targets: %w", err)
+	}
+	targets := append([]string(nil), cfg.Targets...)
+	for _, t := range discovered {
+		if !slices.Contains(targets, t) {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// runMatrix implements "bld matrix": for every model it ensures a branch and
+// worktree exist and then asks aider to make each target build.
+func runMatrix(ctx context.Context, args []string) error {
+	fs := newFlagSet("matrix")
+	common := registerCommonFlags(fs)
+	cacheOpts := registerCacheFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "print the branches, worktrees, files and commands of the run without changing anything")
+	planFormat := fs.String("plan-format", "text", "format of the -dry-run plan: text or json")
+	resume := fs.Bool("resume", false, "continue the last run of this branch, skipping the cells it completed")
+	jobs := fs.Int("jobs", 1, "number of models to run concurrently")
+	fs.Parse(args)
+	if *jobs < 1 {
+		return fmt.Errorf("-jobs: must be at least 1")
+	}
+	if *planFormat != "text" && *planFormat != "json" {
+		return fmt.Errorf("-plan-format: unknown format %q; want text or json", *planFormat)
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Models) == 0 {
+		return &configError{Key: "models", Msg: "at least one model is required; set it in the config file or pass -models"}
+	}
+	prompts, err := loadPrompts(cfg)
+	if err != nil {
+		return err
+	}
+	wd := cfg.Repo
+	r := newRunner(cfg)
+	targets, err := resolveTargets(ctx, r, cfg)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return &configError{Key: "targets", Msg: "at least one target is required; set it in the config file, pass -targets, or enable discovery"}
+	}
+
+	branch, err := getGitBranch(ctx, r, wd)
+	if err != nil {
+		return fmt.Errorf("error getting git branch: %w", err)
+	}
+	log.Printf("Current git branch: %s\n", branch)
+
+	worktreeBaseDir, err := cfg.worktreeBaseDir()
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		p, err := planMatrix(ctx, r, cfg, prompts, branch, worktreeBaseDir, targets)
+		if err != nil {
+			return fmt.Errorf("error planning matrix: %w", err)
+		}
+		if *planFormat == "json" {
+			return p.writeJSON(os.Stdout)
+		}
+		return p.writeText(os.Stdout)
+	}
+
+	state, err := openRunState(runStatePath(worktreeBaseDir, branch), *resume, wd, branch)
+	if err != nil {
+		return err
+	}
+	if *resume {
+		log.Printf("Resuming run %s from %s", state.RunID, state.path)
+	} else {
+		log.Printf("Starting run %s; state in %s", state.RunID, state.path)
+	}
+	log.Printf("Using prompt variant %s", prompts.variant)
+	cache, err := cacheOpts.open(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if s := cache.summary(); s != "" {
+			log.Print(s)
+		}
+	}()
+
+	m := &matrix{
+		cfg:             cfg,
+		r:               r,
+		prompts:         prompts,
+		cache:           cache,
+		state:           state,
+		branch:          branch,
+		worktreeBaseDir: worktreeBaseDir,
+		targets:         targets,
+		jobs:            *jobs,
+	}
+	err = m.run(ctx)
+	// Print the results so far even when the run failed or was interrupted.
+	fmt.Println()
+	if rerr := newMatrixReport(state).writeMarkdown(os.Stdout); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// matrix runs every model against every target, recording each outcome in
+// its run state.
+type matrix struct {
+	cfg             *config
+	r               runner
+	prompts         *promptSet
+	cache           *responseCache
+	state           *runState
+	branch          string
+	worktreeBaseDir string
+	targets         []string
+	// jobs is the number of models run concurrently.
+	jobs int
+
+	// gitMu serializes the git commands that update state shared by all
+	// worktrees of the repository: branches, worktrees and the refs of
+	// failed attempts.
+	gitMu sync.Mutex
+}
+
+// run runs up to m.jobs models at a time. The first model to fail cancels
+// the others.
+func (m *matrix) run(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(m.jobs)
+	for _, llmModel := range m.cfg.Models {
+		g.Go(func() error {
+			jobCtx := ctx
+			if m.jobs > 1 {
+				jobCtx = withLogger(ctx, log.New(log.Writer(), "["+llmModel+"] ", log.Flags()|log.Lmsgprefix))
+			}
+			if err := m.runModel(jobCtx, llmModel); err != nil {
+				return fmt.Errorf("model %s: %w", llmModel, err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// runModel ensures the branch and worktree of llmModel exist and then runs
+// each target that is not yet done in the run state.
+func (m *matrix) runModel(ctx context.Context, llmModel string) error {
+	logger := loggerFrom(ctx)
+	modelBranch, worktreePath := modelWorktree(m.branch, m.worktreeBaseDir, llmModel)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := m.ensureWorktree(ctx, modelBranch, worktreePath); err != nil {
+		return err
+	}
+
+	// For each target, invoke aider in the worktree so the model can make
+	// minimal Bazel changes to build the target.
+	for _, target := range m.targets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cell := m.state.cell(llmModel, target)
+		if cell.done() {
+			logger.Printf("Skipping model %s target %s: %s in run %s", llmModel, target, cell.Status, m.state.RunID)
+			continue
+		}
+		if err := m.runCell(ctx, cell, worktreePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureWorktree creates the branch and worktree of a model if needed.
+func (m *matrix) ensureWorktree(ctx context.Context, modelBranch, worktreePath string) error {
+	m.gitMu.Lock()
+	defer m.gitMu.Unlock()
+
+	// Ensure branch exists (create if needed)
+	if err := createGitBranchIfNotExists(ctx, m.r, m.cfg.Repo, modelBranch); err != nil {
+		return fmt.Errorf("error ensuring branch %s exists: %w", modelBranch, err)
+	}
+
+	// Ensure worktree exists (create if needed)
+	if err := createGitWorktreeIfNotExists(ctx, m.r, m.cfg.Repo, worktreePath, modelBranch); err != nil {
+		return fmt.Errorf("error ensuring worktree at %s exists: %w", worktreePath, err)
+	}
+	// Keep bazel's symlinks out of the model branch and the attempt refs.
+	return gitExcludeBazelSymlinks(ctx, m.r, worktreePath)
+}
+
+// discard saves the changes of cell's failed attempt in worktreePath,
+// including those the agent committed after base, on the attempt's ref with
+// outcome and details in the commit message, and then resets the worktree to
+// base for the next attempt. See "bld attempts".
+func (m *matrix) discard(ctx context.Context, cell *cellState, worktreePath, base, attempt, outcome string, details []byte) error {
+	m.gitMu.Lock()
+	defer m.gitMu.Unlock()
+	if err := gitResetSoft(ctx, m.r, worktreePath, base); err != nil {
+		return err
+	}
+	ref := attemptRef(m.state.RunID, cell.Model, cell.Target, attempt)
+	saved, err := gitSaveWorktree(ctx, m.r, worktreePath, ref, attemptMessage(m.cfg.Agent, cell.Model, cell.Target, attempt, outcome, details))
+	if err != nil {
+		return err
+	}
+	if saved {
+		loggerFrom(ctx).Printf("Saved attempt %s of model %s target %s as %s", attempt, cell.Model, cell.Target, ref)
+	}
+	if err := gitDiscardChanges(ctx, m.r, worktreePath); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runCell tries to make cell's target build with cell's model, resuming
+// after the attempts already recorded. Failures of the model or of aider are
+// recorded in the cell; only failures to manage the worktree or the run state
+// are returned.
+func (m *matrix) runCell(ctx context.Context, cell *cellState, worktreePath string) (err error) {
+	r := m.r
+	logger := loggerFrom(ctx)
+	llmModel, target := cell.Model, cell.Target
+	artifactDir := runArtifactDir(m.worktreeBaseDir, m.state.RunID, llmModel, target)
+	if err := m.state.update(cell, func(c *cellState) {
+		c.Status = cellRunning
+		c.PromptVariant = m.prompts.variant
+		c.ArtifactDir = artifactDir
+	}); err != nil {
+		return err
+	}
+	// inAttempt is set while an attempt's outcome is undecided, so that an
+	// interrupted attempt is not counted.
+	inAttempt := false
+	// base is the commit the current attempt started from.
+	base := "HEAD"
+	start := time.Now()
+	defer func() {
+		if ctx.Err() != nil && cell.Status == cellRunning {
+			err = m.interrupt(ctx, cell, worktreePath, base, inAttempt)
+		}
+		if uerr := m.state.update(cell, func(c *cellState) { c.WallSeconds += time.Since(start).Seconds() }); err == nil {
+			err = uerr
+		}
+	}()
+
+	placeholder, err := ensureBuildBazelExists(ctx, worktreePath, target)
+	if err != nil {
+		return fmt.Errorf("error ensuring BUILD.bazel for target %s: %w", target, err)
+	}
+	// determine the BUILD.bazel path for the target to pass to aider
+	buildArg, _ := targetBuildFile(target)
+	// Pre-check: If bazel query then bazel build succeed without changes, skip aider.
+	queryOut, queryErr := runBazelQueryTarget(ctx, r, worktreePath, target)
+	if queryErr == nil {
+		// Query succeeded; try building directly.
+		bazelOut, bazelErr := runBazelBuild(ctx, r, worktreePath, target)
+		if bazelErr == nil {
+			logger.Printf("bazel query and build succeeded for model %s target %s; skipping %s", llmModel, target, m.cfg.Agent)
+			// The target builds without the placeholder; remove it so
+			// that it is not committed with a later target's changes.
+			if placeholder != "" {
+				if err := os.Remove(placeholder); err != nil {
+					return fmt.Errorf("error removing placeholder: %w", err)
+				}
+			}
+			return m.succeed(ctx, cell, worktreePath)
+		}
+		logger.Printf("Pre-check bazel build failed for model %s target %s: %v\n%s", llmModel, target, bazelErr, string(bazelOut))
+		// Fall through to aider loop to attempt fixes.
+	} else {
+		logger.Printf("Pre-check bazel query failed for model %s target %s: %v\n%s", llmModel, target, queryErr, string(queryOut))
+		// Fall through to aider loop to attempt fixes.
+	}
+
+	// Try up to N attempts per model/target using the agent to produce Bazel changes.
+	maxAttempts := m.cfg.MaxAttempts
+	// retryReason tells the model why its previous attempt failed.
+	retryReason := ""
+	// violation lists the files the last attempt was rejected for changing.
+	violation := ""
+	for attempt := cell.Attempts + 1; attempt <= maxAttempts; attempt++ {
+		if spent, over := m.state.overBudget(llmModel, m.cfg.BudgetUSD); over {
+			logger.Printf("Model %s has spent $%.2f of its $%.2f budget; not attempting target %s", llmModel, spent, m.cfg.BudgetUSD, target)
+			return m.state.update(cell, func(c *cellState) { c.Status = cellOverBudget })
+		}
+		if err := m.state.update(cell, func(c *cellState) { c.Attempts = attempt }); err != nil {
+			return err
+		}
+		inAttempt = true
+		violation = ""
+		art, err := newAttemptArtifacts(artifactDir, attempt)
+		if err != nil {
+			return err
+		}
+		// The files the attempt changes are found by comparing with base,
+		// which also catches changes aider committed.
+		base, err = getGitHead(ctx, r, worktreePath)
+		if err != nil {
+			return err
+		}
+		var u tokenUsage
+		var retries int
+		if m.cfg.Agent == agentOneShot {
+			u, retries, err = m.runOneShot(ctx, art, worktreePath, llmModel, target, retryReason, attempt)
+		} else {
+			message, rerr := m.prompts.render(promptAider, promptData{Target: target, PackageDir: packageDir(target), PreviousError: retryReason})
+			if rerr != nil {
+				return rerr
+			}
+			if werr := art.write(artifactPrompt, []byte(message+"\n")); werr != nil {
+				return werr
+			}
+			if m.cfg.Agent == agentNative {
+				u, retries, err = m.runNativeAgent(ctx, art, worktreePath, llmModel, message)
+			} else {
+				u, retries, err = m.runAider(ctx, art, worktreePath, llmModel, target, buildArg, message)
+			}
+		}
+		retryReason = ""
+		if uerr := m.state.update(cell, func(c *cellState) {
+			c.Usage.add(u)
+			c.AttemptUsage = append(c.AttemptUsage, attemptUsage{Attempt: attempt, Retries: retries, tokenUsage: u})
+			c.Retries += retries
+		}); uerr != nil {
+			return uerr
+		}
+		var rejected *rejectedReply
+		if errors.As(err, &rejected) {
+			logger.Printf("Reply of model %s for target %s was rejected: %v", llmModel, target, rejected)
+			if err := art.write(artifactReplyErrors, []byte(rejected.Error()+"\n")); err != nil {
+				return err
+			}
+			if err := art.outcome("reply rejected"); err != nil {
+				return err
+			}
+			// Nothing was written, so there is nothing to save.
+			inAttempt = false
+			retryReason = rejected.Error()
+			logger.Printf("Asking model %s again for target %s after a rejected reply (attempt %d/%d)", llmModel, target, attempt, maxAttempts)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Printf("%s failed for model %s target %s: %v", m.cfg.Agent, llmModel, target, err)
+			outcome := fmt.Sprintf("%s failed: %v", m.cfg.Agent, err)
+			if aerr := art.outcome("%s", outcome); aerr != nil {
+				return aerr
+			}
+			// Leave the worktree clean for the next target.
+			if derr := m.discard(ctx, cell, worktreePath, base, strconv.Itoa(attempt), outcome, nil); derr != nil {
+				return derr
+			}
+			return m.state.update(cell, func(c *cellState) {
+				c.Status = cellError
+				c.Error = outcome
+			})
+		}
+		logger.Printf("%s completed for model %s target %s (attempt %d/%d)", m.cfg.Agent, llmModel, target, attempt, maxAttempts)
+
+		// Enforce the policy on the files an attempt may change.
+		violations, err := policyViolations(ctx, r, worktreePath, base, m.cfg.Policy)
+		if err != nil {
+			return err
+		}
+		if len(violations) > 0 {
+			list := strings.Join(violations, ", ")
+			if err := art.write(artifactPolicy, []byte(strings.Join(violations, "\n")+"\n")); err != nil {
+				return err
+			}
+			if err := m.state.update(cell, func(c *cellState) { c.PolicyViolations++ }); err != nil {
+				return err
+			}
+			// Undo what aider committed too, so that the violating
+			// changes are reverted or saved with the rest.
+			if err := gitResetSoft(ctx, r, worktreePath, base); err != nil {
+				return err
+			}
+			if m.cfg.Policy.OnViolation == policyRevert {
+				logger.Printf("Model %s changed files outside policy.allowed_files for target %s; reverting %s", llmModel, target, list)
+				if err := gitRestoreFiles(ctx, r, worktreePath, base, violations); err != nil {
+					return err
+				}
+			} else {
+				logger.Printf("Model %s changed files outside policy.allowed_files for target %s: %s", llmModel, target, list)
+				if err := art.writeDiff(ctx, r, worktreePath); err != nil {
+					return err
+				}
+				outcome := "policy violation: changed " + list
+				if err := art.outcome("%s", outcome); err != nil {
+					return err
+				}
+				if err := m.discard(ctx, cell, worktreePath, base, strconv.Itoa(attempt), outcome, nil); err != nil {
+					return err
+				}
+				inAttempt = false
+				violation = list
+				retryReason = "Only Bazel files may be changed, but you changed " + list
+				logger.Printf("Re-invoking %s for model %s target %s after a policy violation (attempt %d/%d)", m.cfg.Agent, llmModel, target, attempt, maxAttempts)
+				continue
+			}
+		}
+
+		// Format the Bazel files the agent changed; files that do not parse
+		// fail the attempt without a round trip through bazel.
+		problems, err := formatChangedBazelFiles(ctx, r, worktreePath, base)
+		if err != nil {
+			return err
+		}
+		if err := art.writeDiff(ctx, r, worktreePath); err != nil {
+			return err
+		}
+		if problems != "" {
+			logger.Printf("Bazel files do not parse for model %s target %s:\n%s", llmModel, target, problems)
+			if err := art.write(artifactParseErrors, []byte(problems+"\n")); err != nil {
+				return err
+			}
+			if err := art.outcome("Bazel files do not parse"); err != nil {
+				return err
+			}
+			if err := m.discard(ctx, cell, worktreePath, base, strconv.Itoa(attempt), "Bazel files do not parse", []byte(problems)); err != nil {
+				return err
+			}
+			inAttempt = false
+			retryReason = "These Bazel files do not parse:\n" + problems
+			logger.Printf("Re-invoking %s for model %s target %s after a parse error (attempt %d/%d)", m.cfg.Agent, llmModel, target, attempt, maxAttempts)
+			continue
+		}
+
+		// After aider, first run 'bazel query' to check target visibility/resolution.
+		queryOut, queryErr := runBazelQueryTarget(ctx, r, worktreePath, target)
+		if err := art.write(artifactBazelQuery, queryOut); err != nil {
+			return err
+		}
+		if queryErr != nil {
+			logger.Printf("bazel query failed for model %s target %s: %v\n%s", llmModel, target, queryErr, string(queryOut))
+			outcome := fmt.Sprintf("bazel query failed: %v", queryErr)
+			if err := art.outcome("%s", outcome); err != nil {
+				return err
+			}
+			// Save and discard the attempt's changes and retry.
+			if err := m.discard(ctx, cell, worktreePath, base, strconv.Itoa(attempt), outcome, queryOut); err != nil {
+				return err
+			}
+			inAttempt = false
+			retryReason = fmt.Sprintf("bazel query %s failed:\n%s", target, outputTail(queryOut, maxRetryOutput))
+			logger.Printf("Re-invoking %s for model %s target %s after failed bazel query (attempt %d/%d)", m.cfg.Agent, llmModel, target, attempt, maxAttempts)
+			continue
+		}
+
+		// Query succeeded; attempt to build the target.
+		bazelOut, bazelErr := runBazelBuild(ctx, r, worktreePath, target)
+		if err := art.write(artifactBazelBuild, bazelOut); err != nil {
+			return err
+		}
+		if bazelErr != nil {
+			logger.Printf("bazel build failed for model %s target %s: %v\n%s", llmModel, target, bazelErr, string(bazelOut))
+			outcome := fmt.Sprintf("bazel build failed: %v", bazelErr)
+			if err := art.outcome("%s", outcome); err != nil {
+				return err
+			}
+			// Save and discard the attempt's changes and retry.
+			if err := m.discard(ctx, cell, worktreePath, base, strconv.Itoa(attempt), outcome, bazelOut); err != nil {
+				return err
+			}
+			inAttempt = false
+			retryReason = fmt.Sprintf("bazel build %s failed:\n%s", target, outputTail(bazelOut, maxRetryOutput))
+			logger.Printf("Re-invoking %s for model %s target %s after failed bazel build (attempt %d/%d)", m.cfg.Agent, llmModel, target, attempt, maxAttempts)
+			continue
+		}
+
+		// Bazel build succeeded. Commit any untracked or dirty files and move on.
+		if err := art.outcome("succeeded"); err != nil {
+			return err
+		}
+		commitMsg := matrixCommitMessage(m.cfg.Agent, llmModel, target)
+		committed, err := gitCommitAll(ctx, r, worktreePath, commitMsg)
+		if err != nil {
+			return err
+		}
+		if committed {
+			logger.Printf("Committed changes in %s: %s", worktreePath, commitMsg)
+		} else {
+			logger.Printf("No changes to commit in %s for model %s target %s", worktreePath, llmModel, target)
+		}
+
+		logger.Printf("bazel build succeeded for model %s target %s", llmModel, target)
+		return m.succeed(ctx, cell, worktreePath)
+	}
+	logger.Printf("Maximum attempts (%d) reached for model %s target %s; moving on to next target/worktree", maxAttempts, llmModel, target)
+	return m.state.update(cell, func(c *cellState) {
+		c.Status = cellFailed
+		c.Error = ""
+		if violation != "" {
+			c.Status = cellPolicyViolation
+			c.Error = "changed files outside policy.allowed_files: " + violation
+		}
+	})
+}
+
+// runAider runs aider with message in the worktree, saving its output with
+// the attempt's artifacts. Aider's crashes and provider failures are retried
+// without counting as attempts. runAider returns the usage aider reported,
+// including that of the runs retried, and the number of retries.
+func (m *matrix) runAider(ctx context.Context, art *attemptArtifacts, worktreePath, model, target, buildFile, message string) (tokenUsage, int, error) {
+	logger := loggerFrom(ctx)
+	aiderCmd := newAiderCommand(worktreePath, model, target, buildFile, message)
+	provider, _ := modelProvider(m.cfg, model)
+	var res *result
+	var u tokenUsage
+	retries, err := retry(ctx, m.cfg.Retry, fmt.Sprintf("aider for model %s target %s", model, target), func(err error) bool {
+		return isTransientAiderFailure(err, res)
+	}, func() error {
+		if l := providerLimiter(m.cfg, provider); l != nil {
+			if err := l.wait(ctx); err != nil {
+				return err
+			}
+		}
+		var aiderLog *lineWriter
+		if m.jobs > 1 {
+			// Prefix aider's output like the rest of the job's log.
+			aiderLog = newLineWriter(logger)
+			aiderCmd.Stdout, aiderCmd.Stderr = aiderLog, aiderLog
+		}
+		var err error
+		res, err = m.r.Run(ctx, aiderCmd)
+		if aiderLog != nil {
+			aiderLog.flush()
+		}
+		if res != nil {
+			u.add(parseAiderUsage(res.Combined))
+			if aerr := art.appendTo(artifactAiderLog, res.Combined); aerr != nil {
+				logger.Print(aerr)
+			}
+		}
+		return err
+	})
+	return u, retries, err
+}
+
+// runNativeAgent runs the native agent with message as its task in the
+// worktree, saving the conversation with the attempt's artifacts. Its
+// failed requests are retried without counting as attempts.
+func (m *matrix) runNativeAgent(ctx context.Context, art *attemptArtifacts, worktreePath, model, message string) (tokenUsage, int, error) {
+	transcript, err := art.create(artifactAgentLog)
+	if err != nil {
+		return tokenUsage{}, 0, err
+	}
+	defer transcript.Close()
+	a, err := newBuildAgent(m.r, m.cfg, model, worktreePath, transcript)
+	if err != nil {
+		return tokenUsage{}, 0, err
+	}
+	return a.run(ctx, message)
+}
+
+// runOneShot asks model in a single request for the Bazel files of target's
+// package, given the crate's context and the package's current BUILD.bazel,
+// and writes the files of the reply to the worktree. A reply that holds no
+// files, edits that do not apply or files that do not parse is returned as a
+// *rejectedReply. Only the first attempt may use a cached reply; a later one
+// asks again, as the cached reply is likely the one that failed.
+func (m *matrix) runOneShot(ctx context.Context, art *attemptArtifacts, worktreePath, model, target, previousError string, attempt int) (tokenUsage, int, error) {
+	logger := loggerFrom(ctx)
+	pkgDir := packageDir(target)
+	buildFile := path.Join(pkgDir, "BUILD.bazel")
+	var input strings.Builder
+	current, err := os.ReadFile(filepath.Join(worktreePath, filepath.FromSlash(buildFile)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return tokenUsage{}, 0, fmt.Errorf("error reading %s: %w", buildFile, err)
+	}
+	if len(current) > 0 {
+		fmt.Fprintf(&input, "--- %s ---\n%s\n\n", buildFile, strings.TrimRight(string(current), "\n"))
+	}
+	crate, err := crateContext(ctx, m.r, worktreePath, pkgDir, m.cfg.ContextBytes)
+	if err != nil {
+		// Not every package is a crate.
+		logger.Printf("No crate context for %s: %v", target, err)
+	}
+	input.WriteString(crate)
+
+	cache := m.cache
+	if attempt > 1 {
+		cache = nil
+	}
+	files, prompt, c, err := runLLM(ctx, m.r, m.cfg, m.prompts, cache, model, worktreePath, pkgDir, previousError, input.String())
+	if prompt != "" {
+		if err := art.write(artifactPrompt, []byte(prompt+"\n")); err != nil {
+			return tokenUsage{}, 0, err
+		}
+		if err := art.write(artifactInput, []byte(input.String())); err != nil {
+			return tokenUsage{}, 0, err
+		}
+	}
+	if c == nil {
+		return tokenUsage{}, 0, err
+	}
+	u := c.Usage.tokenUsage()
+	if werr := art.write(artifactResponse, []byte(c.Content)); werr != nil {
+		return u, c.Retries, werr
+	}
+	if err != nil {
+		return u, c.Retries, &rejectedReply{err}
+	}
+	// Apply the policy before anything is written. With on_violation =
+	// "revert" the files it does not allow are left out, as they would be
+	// reverted.
+	var kept []bazelFile
+	var denied []string
+	for _, f := range files {
+		if !m.cfg.Policy.allows(f.Path) {
+			denied = append(denied, f.Path)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if len(denied) > 0 {
+		if m.cfg.Policy.OnViolation != policyRevert || len(kept) == 0 {
+			return u, c.Retries, &rejectedReply{fmt.Errorf("only Bazel files matching %s may be changed, but the reply changes %s", strings.Join(m.cfg.Policy.AllowedFiles, ", "), strings.Join(denied, ", "))}
+		}
+		logger.Printf("Leaving out %s of model %s for target %s, which policy.allowed_files does not allow", strings.Join(denied, ", "), model, target)
+		files = kept
+	}
+	if _, err := writeBazelFiles(worktreePath, files); err != nil {
+		return u, c.Retries, err
+	}
+	logger.Printf("Wrote %s for model %s target %s", describeFiles(files), model, target)
+	return u, c.Retries, nil
+}
+
+// rejectedReply is the error of an attempt whose reply could not be used.
+// The model is told why in its next attempt.
+type rejectedReply struct {
+	err error
+}
+
+func (e *rejectedReply) Error() string { return e.err.Error() }
+func (e *rejectedReply) Unwrap() error { return e.err }
+
+// interrupt leaves the worktree of an interrupted cell clean by saving and
+// discarding its partial changes since base, including placeholder
+// BUILD.bazel files, and records the cell as interrupted so that -resume
+// retries it. It returns the context's error.
+func (m *matrix) interrupt(ctx context.Context, cell *cellState, worktreePath, base string, inAttempt bool) error {
+	logger := loggerFrom(ctx)
+	logger.Printf("Interrupted model %s target %s; saving partial changes in %s", cell.Model, cell.Target, worktreePath)
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	attempt := strconv.Itoa(cell.Attempts) + "-interrupted"
+	if err := m.discard(cleanupCtx, cell, worktreePath, base, attempt, "bld was interrupted", nil); err != nil {
+		return errors.Join(ctx.Err(), err)
+	}
+	if err := m.state.update(cell, func(c *cellState) {
+		c.Status = cellInterrupted
+		if inAttempt {
+			c.Attempts--
+		}
+	}); err != nil {
+		return errors.Join(ctx.Err(), err)
+	}
+	return ctx.Err()
+}
+
+// cleanupTimeout bounds the cleanup of a worktree after an interruption.
+const cleanupTimeout = time.Minute
+
+// maxRetryOutput bounds the bazel output the next attempt is told about.
+const maxRetryOutput = 8 << 10
+
+// succeed records that cell's target builds at the worktree's HEAD.
+func (m *matrix) succeed(ctx context.Context, cell *cellState, worktreePath string) error {
+	head, err := getGitHead(ctx, m.r, worktreePath)
+	if err != nil {
+		return err
+	}
+	return m.state.update(cell, func(c *cellState) {
+		c.Status = cellSucceeded
+		c.Commit = head
+		c.Error = ""
+	})
+}
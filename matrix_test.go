@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNewAiderCommand(t *testing.T) {
+	c := newAiderCommand("/wt", "openrouter/m", "//crates/a:a", "crates/a/BUILD.bazel", "make it build")
+	if c.Dir != "/wt" {
+		t.Errorf("Dir = %s, want /wt", c.Dir)
+	}
+	want := []string{
+		"aider",
+		"--disable-playwright",
+		"--yes-always",
+		"--model", "openrouter/m",
+		"--edit-format", "diff",
+		"--auto-test",
+		"--test-cmd", "bazel build //crates/a:a",
+		"--message", "make it build",
+		"MODULE.bazel",
+		"crates/a/BUILD.bazel",
+	}
+	if got := argv(c); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 const rulesRustVersion = "0.64.0"
@@ -64,31 +67,17 @@ use_repo(crate, "crates")
 	return nil
 }
 
-// runBazelModExplain executes 'bazel mod explain' in the given directory.
-func runBazelModExplain(dir string) ([]byte, error) {
-	cmd := exec.Command("bazel", "mod", "explain")
-	cmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", cmd.Path, cmd.Args)
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v", cmd.Path, err)
-		return nil, fmt.Errorf("'bazel mod explain' failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", cmd.Path)
-	return output, nil
-}
-
 // rulesRustExists checks if the rules_rust module is present by running 'bazel mod explain'.
-func rulesRustExists(dir string) (bool, error) {
-	output, err := runBazelModExplain(dir)
+func rulesRustExists(ctx context.Context, r runner, dir string) (bool, error) {
+	output, err := runBazelModExplain(ctx, r, dir)
 	if err != nil {
 		return false, err
 	}
 	return bytes.Contains(output, []byte("rules_rust")), nil
 }
 
-func addRulesRustDependencyIfNecessary(dir string) error {
-	exists, err := rulesRustExists(dir)
+func addRulesRustDependencyIfNecessary(ctx context.Context, r runner, dir string) error {
+	exists, err := rulesRustExists(ctx, r, dir)
 	if err != nil {
 		return err
 	}
@@ -98,220 +87,19 @@ func addRulesRustDependencyIfNecessary(dir string) error {
 	if err := addRulesRustDependency(dir); err != nil {
 		return err
 	}
-	added, err := rulesRustExists(dir)
+	added, err := rulesRustExists(ctx, r, dir)
 	if err != nil {
 		return err
 	}
 	if !added {
 		return fmt.Errorf("adding rules_rust did not succeed")
 	}
-	return commitModuleFiles(dir, fmt.Sprintf("migration: add rules_rust@%s to MODULE.bazel", rulesRustVersion))
-}
-
-// runBazelQuery executes 'bazel query //...' and logs the number of targets.
-func runBazelQuery(dir string) {
-	queryCmd := exec.Command("bazel", "query", "//...")
-	queryCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", queryCmd.Path, queryCmd.Args)
-	queryOutput, err := queryCmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v\n", queryCmd.Path, err)
-	} else {
-		numTargets := 0
-		if len(queryOutput) > 0 {
-			numTargets = len(bytes.Split(queryOutput, []byte("\n")))
-			if len(queryOutput) > 0 && queryOutput[len(queryOutput)-1] == '\n' {
-				numTargets--
-			}
-		}
-		log.Printf("command %s completed successfully. found %d targets.\n", queryCmd.Path, numTargets)
-	}
-}
-
-// hasBazelBuildTargets checks if there are any bazel build targets by running 'bazel query <query>'.
-func hasBazelBuildTargets(dir string, query string) (bool, error) {
-	queryCmd := exec.Command("bazel", "query", query)
-	queryCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", queryCmd.Path, queryCmd.Args)
-	queryOutput, err := queryCmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			// Bazel query returns non-zero exit code if no targets are found.
-			// We check stderr to differentiate between no targets and other errors.
-			if bytes.Contains(exitErr.Stderr, []byte("no targets found")) {
-				log.Printf("command %s completed successfully. found 0 targets.\n", queryCmd.Path)
-				return false, nil
-			}
-		}
-		log.Printf("command %s failed: %v\n", queryCmd.Path, err)
-		return false, fmt.Errorf("'bazel query //...' failed: %w", err)
-	}
-	numTargets := 0
-	if len(queryOutput) > 0 {
-		numTargets = len(bytes.Split(queryOutput, []byte("\n")))
-		if len(queryOutput) > 0 && queryOutput[len(queryOutput)-1] == '\n' {
-			numTargets--
-		}
-	}
-	log.Printf("command %s completed successfully. found %d targets.\n", queryCmd.Path, numTargets)
-	return numTargets > 0, nil
-}
-
-// getRustCrateNames returns a list of Rust crate names by running 'cargo metadata' and parsing its output.
-func getRustCrateNames(dir string) ([]string, error) {
-	cargoCmd := exec.Command("cargo", "metadata", "--format-version", "1", "--no-deps")
-	cargoCmd.Dir = dir
-	log.Printf("running command: %s %s", cargoCmd.Path, cargoCmd.Args)
-	cargoOutput, err := cargoCmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v\n", cargoCmd.Path, err)
-		return nil, fmt.Errorf("'cargo metadata' failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", cargoCmd.Path)
-
-	jqCmd := exec.Command("jq", "-r", ".packages[].name")
-	jqCmd.Stdin = bytes.NewReader(cargoOutput)
-	log.Printf("running command: %s %s", jqCmd.Path, jqCmd.Args)
-	jqOutput, err := jqCmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v\n", jqCmd.Path, err)
-		return nil, fmt.Errorf("'jq' failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", jqCmd.Path)
-
-	names := bytes.Split(bytes.TrimSpace(jqOutput), []byte("\n"))
-	result := make([]string, 0, len(names))
-	for _, name := range names {
-		if len(name) > 0 {
-			result = append(result, string(name))
-		}
-	}
-	return result, nil
-}
-
-// getRustCrateDependencies returns a list of dependency names for a given crate by running 'cargo tree'.
-func getRustCrateDependencies(dir string, crateName string) ([]string, error) {
-	cargoCmd := exec.Command("cargo", "tree", "--package", crateName, "--prefix", "none")
-	cargoCmd.Dir = dir
-	log.Printf("running command: %s %s", cargoCmd.Path, cargoCmd.Args)
-	cargoOutput, err := cargoCmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v\n", cargoCmd.Path, err)
-		return nil, fmt.Errorf("'cargo tree' failed for crate %s: %w", crateName, err)
-	}
-	log.Printf("command %s completed successfully.", cargoCmd.Path)
-
-	// The output of `cargo tree --prefix none` lists each dependency on a new line.
-	lines := bytes.Split(bytes.TrimSpace(cargoOutput), []byte("\n"))
-	result := make([]string, 0, len(lines))
-	for _, line := range lines {
-		if len(line) > 0 {
-			result = append(result, string(line))
-		}
-	}
-	return result, nil
-}
-
-// getCrateWithFewestDependencies returns the name of the crate with the fewest dependencies.
-func getCrateWithFewestDependencies(dir string) (string, error) {
-	crateNames, err := getRustCrateNames(dir)
-	if err != nil {
-		return "", fmt.Errorf("error getting Rust crate names: %w", err)
-	}
-
-	if len(crateNames) == 0 {
-		return "", nil // No crates found
-	}
-
-	minDependencies := -1
-	crateWithFewestDependencies := ""
-
-	for _, crateName := range crateNames {
-		dependencies, err := getRustCrateDependencies(dir, crateName)
-		if err != nil {
-			return "", fmt.Errorf("error getting dependencies for crate %s: %w", crateName, err)
-		}
-
-		numDependencies := len(dependencies)
-		if minDependencies == -1 || numDependencies < minDependencies {
-			minDependencies = numDependencies
-			crateWithFewestDependencies = crateName
-		}
-	}
-	return crateWithFewestDependencies, nil
-}
-
-// getCargoTomlPath returns the path to the Cargo.toml file for a given crate name.
-func getCargoTomlPath(dir string, crateName string) (string, error) {
-	cargoCmd := exec.Command("cargo", "metadata", "--format-version", "1")
-	cargoCmd.Dir = dir
-	log.Printf("running command: %s %s", cargoCmd.Path, cargoCmd.Args)
-	cargoOutput, err := cargoCmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v\n", cargoCmd.Path, err)
-		return "", fmt.Errorf("'cargo metadata' failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", cargoCmd.Path)
-
-	jqQuery := fmt.Sprintf(".packages[] | select(.name == \"%s\") | .manifest_path", crateName)
-	jqCmd := exec.Command("jq", "-r", jqQuery)
-	jqCmd.Stdin = bytes.NewReader(cargoOutput)
-	log.Printf("running command: %s %s", jqCmd.Path, jqCmd.Args)
-	jqOutput, err := jqCmd.Output()
-	if err != nil {
-		log.Printf("command %s failed: %v\n", jqCmd.Path, err)
-		return "", fmt.Errorf("'jq' failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", jqCmd.Path)
-
-	path := string(bytes.TrimSpace(jqOutput))
-	if path == "" {
-		return "", fmt.Errorf("Cargo.toml path not found for crate: %s", crateName)
-	}
-	relativePath, err := filepath.Rel(dir, path)
-	if err != nil {
-		return "", fmt.Errorf("error getting relative path for %s: %w", path, err)
-	}
-	return relativePath, nil
-}
-
-// getFilesContent reads the content of the specified files and returns them as a map.
-func getFilesContent(filePaths []string) (map[string][]byte, error) {
-	contents := make(map[string][]byte)
-	for _, filePath := range filePaths {
-		content, err := os.ReadFile(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("error reading file %s: %w", filePath, err)
-		}
-		contents[filePath] = content
-	}
-	return contents, nil
+	return commitModuleFiles(ctx, r, dir, fmt.Sprintf("migration: add rules_rust@%s to MODULE.bazel", rulesRustVersion))
 }
 
 // commitModuleFiles adds and commits MODULE.bazel and MODULE.bazel.lock.
-func commitModuleFiles(dir string, message string) error {
-	moduleFilePath := filepath.Join(dir, "MODULE.bazel")
-	moduleLockFilePath := filepath.Join(dir, "MODULE.bazel.lock")
-
-	gitAddCmd := exec.Command("git", "add", moduleFilePath, moduleLockFilePath)
-	gitAddCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", gitAddCmd.Path, gitAddCmd.Args)
-	if err := gitAddCmd.Run(); err != nil {
-		log.Printf("command %s failed: %v", gitAddCmd.Path, err)
-		return fmt.Errorf("error adding %s and %s to git: %w", moduleFilePath, moduleLockFilePath, err)
-	}
-	log.Printf("command %s completed successfully.", gitAddCmd.Path)
-
-	gitCommitCmd := exec.Command("git", "commit", "-m", message)
-	gitCommitCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", gitCommitCmd.Path, gitCommitCmd.Args)
-	if err := gitCommitCmd.Run(); err != nil {
-		log.Printf("command %s failed: %v", gitCommitCmd.Path, err)
-		return fmt.Errorf("error committing %s and %s: %w", moduleFilePath, moduleLockFilePath, err)
-	}
-	log.Printf("command %s completed successfully.", gitCommitCmd.Path)
-	log.Printf("%s and %s committed successfully.\n", moduleFilePath, moduleLockFilePath)
-	return nil
+func commitModuleFiles(ctx context.Context, r runner, dir string, message string) error {
+	return gitCommitPaths(ctx, r, dir, message, filepath.Join(dir, "MODULE.bazel"), filepath.Join(dir, "MODULE.bazel.lock"))
 }
 
 // buildFileExists checks if a BUILD.bazel or BUILD file exists in the given directory.
@@ -353,69 +141,7 @@ func createEmptyBuildFile(dir string) error {
 	return nil
 }
 
-// invokeLLM invokes the llm tool with the given prompt, model, input buffer, and extra arguments.
-func invokeLLM(prompt, model string, inputBuffer []byte, extraArgs []string) ([]byte, error) {
-	args := []string{"-m", model, "-s", prompt}
-	args = append(args, extraArgs...)
-	cmd := exec.Command("llm", args...)
-	cmd.Stdin = bytes.NewReader(inputBuffer)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "OPENROUTER_API_KEY="+os.Getenv("OPENROUTER_API_KEY"))
-	cmd.Env = append(cmd.Env, "OPENROUTER_KEY="+os.Getenv("OPENROUTER_KEY"))
-
-	log.Printf("running command: %s %s", cmd.Path, cmd.Args)
-	output, err := cmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			log.Printf("command %s failed with stderr: %s", cmd.Path, exitErr.Stderr)
-		}
-		log.Printf("command %s failed: %v", cmd.Path, err)
-		return nil, fmt.Errorf("'llm' command failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", cmd.Path)
-	return output, nil
-}
-
-// commitBuildFile adds and commits a specific BUILD.bazel file.
-func commitBuildFile(buildFilePath string, message string) error {
-	// Get the directory containing the BUILD.bazel file
-	dir := filepath.Dir(buildFilePath)
-
-	gitAddCmd := exec.Command("git", "add", buildFilePath)
-	gitAddCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", gitAddCmd.Path, gitAddCmd.Args)
-	if err := gitAddCmd.Run(); err != nil {
-		log.Printf("command %s failed: %v", gitAddCmd.Path, err)
-		return fmt.Errorf("error adding %s to git: %w", buildFilePath, err)
-	}
-	log.Printf("command %s completed successfully.", gitAddCmd.Path)
-
-	gitCommitCmd := exec.Command("git", "commit", "-m", message)
-	gitCommitCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", gitCommitCmd.Path, gitCommitCmd.Args)
-	if err := gitCommitCmd.Run(); err != nil {
-		log.Printf("command %s failed: %v", gitCommitCmd.Path, err)
-		return fmt.Errorf("error committing %s: %w", buildFilePath, err)
-	}
-	log.Printf("command %s completed successfully.", gitCommitCmd.Path)
-	log.Printf("%s committed successfully.\n", buildFilePath)
-	return nil
-}
-
-// runBazelBuild executes 'bazel build <query>' in the given directory.
-func runBazelBuild(dir string, query string) error {
-	buildCmd := exec.Command("bazel", "build", query)
-	buildCmd.Dir = dir // Set the working directory for the command
-	log.Printf("running command: %s %s", buildCmd.Path, buildCmd.Args)
-	if err := buildCmd.Run(); err != nil {
-		log.Printf("command %s failed: %v", buildCmd.Path, err)
-		return fmt.Errorf("'bazel build' failed: %w", err)
-	}
-	log.Printf("command %s completed successfully.", buildCmd.Path)
-	return nil
-}
-
-func createBuildFileIfNecessary(dir string) error {
+func createBuildFileIfNecessary(ctx context.Context, r runner, dir string) error {
 	exists, err := buildFileExists(dir)
 	if err != nil {
 		return err
@@ -426,16 +152,16 @@ func createBuildFileIfNecessary(dir string) error {
 	if err := createEmptyBuildFile(dir); err != nil {
 		return err
 	}
-	return commitBuildFile(filepath.Join(dir, "BUILD.bazel"), "migration: add BUILD.bazel")
+	return gitCommitPaths(ctx, r, dir, "migration: add BUILD.bazel", filepath.Join(dir, "BUILD.bazel"))
 }
 
-func createModuleFileIfNecessary(dir string) error {
+func createModuleFileIfNecessary(ctx context.Context, r runner, dir string) error {
 	exists, err := bzlmodExists(dir)
 	if err != nil {
 		return err
 	}
 	if exists {
-		if _, err := runBazelModExplain(dir); err != nil {
+		if _, err := runBazelModExplain(ctx, r, dir); err != nil {
 			return err
 		}
 		return nil
@@ -443,110 +169,355 @@ func createModuleFileIfNecessary(dir string) error {
 	if err := createEmptyModuleFile(dir); err != nil {
 		return err
 	}
-	if _, err := runBazelModExplain(dir); err != nil {
+	if _, err := runBazelModExplain(ctx, r, dir); err != nil {
 		return err
 	}
-	return commitModuleFiles(dir, "migration: add MODULE.bazel and MODULE.bazel.lock")
+	return commitModuleFiles(ctx, r, dir, "migration: add MODULE.bazel and MODULE.bazel.lock")
 }
 
-func main() {
-	defaultWd := os.Getenv("PWD")
-	if defaultWd == "" {
-		defaultWd = "."
+// runMigrate implements "bld migrate": it prepares MODULE.bazel for rules_rust
+// and asks model for a BUILD.bazel for the crate with the fewest dependencies.
+func runMigrate(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate")
+	common := registerCommonFlags(fs)
+	cacheOpts := registerCacheFlags(fs)
+	ensemble := fs.Bool("ensemble", false, "ask every model in models, -jobs at a time, and commit the smallest BUILD.bazel that builds")
+	jobs := fs.Int("jobs", 1, "number of -ensemble models to run concurrently")
+	fs.Parse(args)
+	if *jobs < 1 {
+		return fmt.Errorf("-jobs: must be at least 1")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
 	}
-	wd := flag.String("wd", defaultWd, "working directory")
-	model := flag.String("model", "openrouter/google/gemini-2.5-flash", "LLM model to use")
-	flag.Parse()
+	cache, err := cacheOpts.open(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if s := cache.summary(); s != "" {
+			log.Print(s)
+		}
+	}()
+	prompts, err := loadPrompts(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Using prompt variant %s", prompts.variant)
+	wd := cfg.Repo
+	r := newRunner(cfg)
 
-	if err := createModuleFileIfNecessary(*wd); err != nil {
-		log.Fatalf("MODULE.bazel does not exist or could not be created: %s", err)
+	if err := createModuleFileIfNecessary(ctx, r, wd); err != nil {
+		return fmt.Errorf("MODULE.bazel does not exist or could not be created: %w", err)
 	}
-	if err := createBuildFileIfNecessary(*wd); err != nil {
-		log.Fatalf("BUILD.bazel does not exist or could not be created: %s", err)
+	if err := createBuildFileIfNecessary(ctx, r, wd); err != nil {
+		return fmt.Errorf("BUILD.bazel does not exist or could not be created: %w", err)
 	}
-	if err := addRulesRustDependencyIfNecessary(*wd); err != nil {
-		log.Fatalf("rules_rust module not present or could not be added: %s", err)
+	if err := addRulesRustDependencyIfNecessary(ctx, r, wd); err != nil {
+		return fmt.Errorf("rules_rust module not present or could not be added: %w", err)
 	}
 
-	crate, err := getCrateWithFewestDependencies(*wd)
+	crate, err := getCrateWithFewestDependencies(ctx, r, wd)
 	if err != nil {
-		log.Fatalf("error getting crate with fewest dependencies: %s", err)
+		return fmt.Errorf("error getting crate with fewest dependencies: %w", err)
 	}
 	if crate == "" {
 		fmt.Println("No Rust crates found in the project.")
-		return
+		return nil
 	}
 
 	fmt.Printf("Crate with fewest dependencies: %s\n", crate)
-	cargoTomlPath, err := getCargoTomlPath(*wd, crate)
+	cargoTomlPath, err := getCargoTomlPath(ctx, r, wd, crate)
 	if err != nil {
-		log.Fatalf("error getting Cargo.toml path for crate %s: %s", crate, err)
+		return fmt.Errorf("error getting Cargo.toml path for crate %s: %w", crate, err)
 	}
 	fmt.Printf("Relative path to Cargo.toml: %s\n", cargoTomlPath)
 
-	moduleBazelPath := filepath.Join(*wd, "MODULE.bazel")
-	filePaths := []string{cargoTomlPath, moduleBazelPath}
-	fileContents, err := getFilesContent(filePaths)
+	crateInput, err := crateContext(ctx, r, wd, filepath.Dir(cargoTomlPath), cfg.ContextBytes)
+	if err != nil {
+		return fmt.Errorf("error describing crate %s: %w", crate, err)
+	}
+	cargoToml, err := os.ReadFile(filepath.Join(wd, cargoTomlPath))
 	if err != nil {
-		log.Fatalf("error getting file contents: %s", err)
+		return fmt.Errorf("error reading %s: %w", cargoTomlPath, err)
 	}
 
-	prompt := fmt.Sprintf("What is the minimal BUILD.bazel file that will build the %s crate using Bazel? Please print just the BUILD.bazel file", crate)
-	var inputBuffer bytes.Buffer
-	for _, filePath := range filePaths {
-		inputBuffer.WriteString(fmt.Sprintf("--- %s ---\n", filePath))
-		inputBuffer.Write(fileContents[filePath])
-		inputBuffer.WriteString("\n\n")
+	// Determine the BUILD.bazel file path.
+	// cargoTomlPath is already relative to wd, so we can directly use it to construct the buildBazelFilePath.
+	buildBazelFilePath := filepath.Join(wd, filepath.Dir(cargoTomlPath), "BUILD.bazel")
+	// buildFileDir should be the absolute path to the directory containing the BUILD.bazel file.
+	buildFileDir := filepath.Dir(buildBazelFilePath)
+
+	// Get the relative path of the buildFileDir from the working directory.
+	// This will be used for the Bazel query.
+	relBuildFileDir, err := filepath.Rel(wd, buildFileDir)
+	if err != nil {
+		return fmt.Errorf("error getting relative path for %s from working directory %s: %w", buildFileDir, wd, err)
+	}
+	worktreeBaseDir, err := cfg.worktreeBaseDir()
+	if err != nil {
+		return err
 	}
+	mg := &crateMigration{
+		cfg:          cfg,
+		r:            r,
+		prompts:      prompts,
+		cache:        cache,
+		crate:        crate,
+		pkgDir:       relBuildFileDir,
+		input:        crateInput,
+		cargoToml:    string(cargoToml),
+		artifactBase: worktreeBaseDir,
+		runID:        newRunID(time.Now()),
+	}
+	log.Printf("Recording attempts under %s", filepath.Join(worktreeBaseDir, "runs", mg.runID))
 
-	llmOutput, err := invokeLLM(prompt, *model, inputBuffer.Bytes(), []string{"-x"})
+	if *ensemble {
+		return mg.runEnsemble(ctx, wd, *jobs)
+	}
+	c, err := mg.run(ctx, cfg.Model, wd, os.Stdout)
 	if err != nil {
-		log.Fatalf("error invoking LLM: %s", err)
+		return err
 	}
+	// Commit the BUILD.bazel file and anything else the model wrote.
+	if err := gitCommitPaths(ctx, r, buildFileDir, migrateCommitMessage(crate, c.model, ""), c.paths...); err != nil {
+		return fmt.Errorf("error committing BUILD.bazel file: %w", err)
+	}
+	return nil
+}
 
-	fmt.Printf("LLM Output:\n%s\n", string(llmOutput))
+// crateMigration asks models for the Bazel files of a crate.
+type crateMigration struct {
+	cfg     *config
+	r       runner
+	prompts *promptSet
+	cache   *responseCache
+	crate   string
+	// pkgDir is the crate's directory relative to the workspace root.
+	pkgDir string
+	// input describes the crate to the model; see crateContext.
+	input     string
+	cargoToml string
+	// The artifacts of each attempt go to the runArtifactDir of runID
+	// under artifactBase.
+	artifactBase string
+	runID        string
+}
 
-	// Determine the BUILD.bazel file path.
-	// cargoTomlPath is already relative to *wd, so we can directly use it to construct the buildBazelFilePath.
-	buildBazelFilePath := filepath.Join(*wd, filepath.Dir(cargoTomlPath), "BUILD.bazel")
+// migrationCandidate is a model's answer that builds the crate.
+type migrationCandidate struct {
+	model string
+	files []bazelFile
+	// paths are the files written in the workspace.
+	paths []string
+}
 
-	// Write the LLM output to the BUILD.bazel file
-	err = os.WriteFile(buildBazelFilePath, llmOutput, 0644)
-	if err != nil {
-		log.Fatalf("error writing to BUILD.bazel file %s: %s", buildBazelFilePath, err)
+// size is the number of bytes in the candidate's files.
+func (c *migrationCandidate) size() int {
+	n := 0
+	for _, f := range c.files {
+		n += len(f.Content)
 	}
-	fmt.Printf("Successfully wrote BUILD.bazel file to %s\n", buildBazelFilePath)
+	return n
+}
 
-	// Run bazel query on the directory of the new BUILD.bazel file
-	// buildFileDir should be the absolute path to the directory containing the BUILD.bazel file.
-	buildFileDir := filepath.Dir(buildBazelFilePath)
+// run asks model for the crate's files in the workspace wd, feeding bazel's
+// errors and the files that caused them back to it until they build or
+// cfg.MaxAttempts attempts have failed. It prints its progress and the
+// model's replies to out.
+func (mg *crateMigration) run(ctx context.Context, model, wd string, out io.Writer) (*migrationCandidate, error) {
+	cfg, logger := mg.cfg, loggerFrom(ctx)
+	buildFileDir := filepath.Join(wd, mg.pkgDir)
+	// Construct the Bazel query to look for targets under the specific directory
+	query := fmt.Sprintf("//%s/...", filepath.ToSlash(mg.pkgDir))
 
-	// Get the relative path of the buildFileDir from the working directory.
-	// This will be used for the Bazel query.
-	relBuildFileDir, err := filepath.Rel(*wd, buildFileDir)
+	artifactDir := runArtifactDir(mg.artifactBase, mg.runID, model, "//"+filepath.ToSlash(mg.pkgDir))
+
+	var previous, feedback string
+	for attempt := 1; attempt <= cfg.MaxAttempts; attempt++ {
+		art, err := newAttemptArtifacts(artifactDir, attempt)
+		if err != nil {
+			return nil, err
+		}
+		prompt, err := mg.prompts.render(promptMigrate, promptData{
+			Crate:         mg.crate,
+			PackageDir:    filepath.ToSlash(mg.pkgDir),
+			PreviousError: feedback,
+			CargoToml:     mg.cargoToml,
+		})
+		if err != nil {
+			return nil, err
+		}
+		input := mg.input
+		if feedback != "" {
+			input += previous
+		}
+		if err := art.write(artifactPrompt, []byte(prompt+"\n")); err != nil {
+			return nil, err
+		}
+		if err := art.write(artifactInput, []byte(input)); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "LLM Output (attempt %d/%d):\n", attempt, cfg.MaxAttempts)
+		reply, err := invokeLLM(ctx, mg.r, cfg, mg.cache, prompt, model, []byte(input), out)
+		fmt.Fprintln(out)
+		if err != nil {
+			if aerr := art.outcome("LLM request failed: %v", err); aerr != nil {
+				logger.Print(aerr)
+			}
+			return nil, fmt.Errorf("error invoking LLM: %w", err)
+		}
+		if err := art.write(artifactResponse, []byte(reply.Content)); err != nil {
+			return nil, err
+		}
+
+		// Extract the files from the reply; besides the BUILD.bazel file it
+		// may hold a MODULE.bazel.
+		files, err := parseBazelFiles(reply.Content, filepath.ToSlash(filepath.Join(mg.pkgDir, "BUILD.bazel")))
+		if err != nil {
+			previous, feedback = "--- previous answer ---\n"+reply.Content+"\n\n", err.Error()
+			if err := art.outcome("%v", err); err != nil {
+				return nil, err
+			}
+			logger.Printf("Attempt %d/%d for crate %s failed: %v", attempt, cfg.MaxAttempts, mg.crate, err)
+			continue
+		}
+		previous = ""
+		for _, f := range files {
+			previous += fmt.Sprintf("--- %s ---\n%s\n", f.Path, f.Content)
+		}
+		if err := formatBazelFiles(files); err != nil {
+			feedback = err.Error()
+			if err := art.write(artifactParseErrors, []byte(feedback+"\n")); err != nil {
+				return nil, err
+			}
+			if err := art.outcome("Bazel files do not parse"); err != nil {
+				return nil, err
+			}
+			logger.Printf("Attempt %d/%d for crate %s failed: LLM output is not valid Starlark: %v", attempt, cfg.MaxAttempts, mg.crate, err)
+			continue
+		}
+
+		writtenPaths, output, err := tryBazelFiles(ctx, mg.r, wd, buildFileDir, query, files, out, art)
+		if err != nil {
+			return nil, err
+		}
+		if output != "" {
+			feedback = output
+			summary, _, _ := strings.Cut(output, "\n")
+			if err := art.outcome("%s", strings.TrimSuffix(summary, ":")); err != nil {
+				return nil, err
+			}
+			logger.Printf("Attempt %d/%d for crate %s failed:\n%s", attempt, cfg.MaxAttempts, mg.crate, output)
+			continue
+		}
+		fmt.Fprintf(out, "Bazel build successful for targets under %s\n", query)
+		if err := art.outcome("succeeded"); err != nil {
+			return nil, err
+		}
+		return &migrationCandidate{model: model, files: files, paths: writtenPaths}, nil
+	}
+	return nil, fmt.Errorf("no attempt to write a BUILD.bazel that builds crate %s succeeded in %d attempts", mg.crate, cfg.MaxAttempts)
+}
+
+// migrateCommitMessage is the message of the commit adding the BUILD.bazel
+// model wrote for crate. notes, if not empty, ends the message.
+func migrateCommitMessage(crate, model, notes string) string {
+	msg := fmt.Sprintf("feat: Add BUILD.bazel for %s crate\n\nModel: %s", crate, model)
+	if notes != "" {
+		msg += "\n\n" + notes
+	}
+	return msg
+}
+
+// maxFeedback bounds the bazel output sent back to the model.
+const maxFeedback = 8 << 10
+
+// tryBazelFiles writes files under wd and checks that query finds targets in
+// buildFileDir and that they build. It returns the paths it wrote. If the
+// check fails, it returns the end of bazel's output; the error is for
+// failures that retrying cannot fix. Unless the files build, those they
+// replaced are restored, even when tryBazelFiles is interrupted. It prints
+// its progress to out and records the changes it makes and bazel's output in
+// art.
+func tryBazelFiles(ctx context.Context, r runner, wd, buildFileDir, query string, files []bazelFile, out io.Writer, art *attemptArtifacts) (paths []string, output string, err error) {
+	saved := make(map[string][]byte)
+	for _, f := range files {
+		p := filepath.Join(wd, filepath.FromSlash(f.Path))
+		content, err := os.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("error reading %s: %w", p, err)
+		}
+		saved[p] = content
+	}
+	built := false
+	defer func() {
+		if built {
+			return
+		}
+		if rerr := restoreFiles(saved); rerr != nil {
+			paths, output, err = nil, "", errors.Join(err, rerr)
+		}
+	}()
+	paths, err = writeBazelFiles(wd, files)
 	if err != nil {
-		log.Fatalf("error getting relative path for %s from working directory %s: %s", buildFileDir, *wd, err)
+		return nil, "", err
+	}
+	fmt.Fprintf(out, "Successfully wrote %s\n", describeFiles(files))
+	if err := art.writeDiff(ctx, r, wd); err != nil {
+		return nil, "", err
+	}
+
+	failed := func(out []byte) ([]string, string, error) {
+		if len(out) > maxFeedback {
+			out = out[len(out)-maxFeedback:]
+		}
+		return nil, strings.TrimSpace(string(out)), nil
 	}
-	// Construct the Bazel query to look for targets under the specific directory
-	query := fmt.Sprintf("//%s/...", relBuildFileDir)
 
-	hasTargets, err := hasBazelBuildTargets(buildFileDir, query)
+	res, err := r.Run(ctx, newBazelQueryCommand(buildFileDir, query))
+	if werr := art.write(artifactBazelQuery, combinedOutput(res)); werr != nil {
+		return nil, "", werr
+	}
 	if err != nil {
-		log.Fatalf("error checking for Bazel build targets in %s: %s", buildFileDir, err)
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return failed(append([]byte("bazel query "+query+" failed:\n"), combinedOutput(res)...))
 	}
-	if !hasTargets {
-		log.Fatalf("No Bazel build targets found under %s after writing BUILD.bazel. LLM might have generated an invalid BUILD.bazel file.", relBuildFileDir)
+	if countQueryTargets(res.Stdout) == 0 {
+		return failed([]byte("bazel query " + query + " found no targets"))
 	}
-	fmt.Printf("Bazel query successful. Found targets under //%s/...\n", relBuildFileDir)
+	fmt.Fprintf(out, "Bazel query successful. Found targets under %s\n", query)
 
-	// Run bazel build on the directory of the new BUILD.bazel file
-	if err := runBazelBuild(buildFileDir, query); err != nil {
-		log.Fatalf("error running Bazel build in %s: %s", buildFileDir, err)
+	buildOut, err := runBazelBuild(ctx, r, buildFileDir, query)
+	if werr := art.write(artifactBazelBuild, buildOut); werr != nil {
+		return nil, "", werr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return failed(append([]byte("bazel build "+query+" failed:\n"), buildOut...))
 	}
-	fmt.Printf("Bazel build successful for targets under //%s/...\n", relBuildFileDir)
+	built = true
+	return paths, "", nil
+}
 
-	// Commit the BUILD.bazel file
-	if err := commitBuildFile(buildBazelFilePath, fmt.Sprintf("feat: Add BUILD.bazel for %s crate", crate)); err != nil {
-		log.Fatalf("error committing BUILD.bazel file: %s", err)
+// restoreFiles puts back the content of files by path, removing those whose
+// content is nil because they did not exist.
+func restoreFiles(saved map[string][]byte) error {
+	for p, content := range saved {
+		var err error
+		if content == nil {
+			err = os.Remove(p)
+		} else {
+			err = os.WriteFile(p, content, 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error restoring %s: %w", p, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryBazelFilesRestores(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		build      func(cancel context.CancelFunc) (*result, error)
+		wantErr    error
+		wantOutput bool
+		wantKept   bool
+	}{
+		{
+			name:     "builds",
+			build:    func(context.CancelFunc) (*result, error) { return &result{}, nil },
+			wantKept: true,
+		},
+		{
+			name: "fails",
+			build: func(context.CancelFunc) (*result, error) {
+				return &result{ExitCode: 1, Combined: []byte("ERROR: no such package")}, errors.New("exit status 1")
+			},
+			wantOutput: true,
+		},
+		{
+			name: "interrupted",
+			build: func(cancel context.CancelFunc) (*result, error) {
+				cancel()
+				return &result{ExitCode: -1}, context.Canceled
+			},
+			wantErr: context.Canceled,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			wd := t.TempDir()
+			module := filepath.Join(wd, "MODULE.bazel")
+			if err := os.WriteFile(module, []byte("module(name = \"m\")\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := &recordingRunner{Respond: func(c *command) (*result, error) {
+				switch {
+				case c.Name == "bazel" && c.Args[0] == "build":
+					return tc.build(cancel)
+				case c.Name == "bazel":
+					return &result{Stdout: []byte("//a:a\n")}, nil
+				}
+				return &result{}, nil
+			}}
+			files := []bazelFile{
+				{Path: "MODULE.bazel", Content: "module(name = \"m\")\nbazel_dep(name = \"rules_rust\")\n"},
+				{Path: "a/BUILD.bazel", Content: "rust_library(name = \"a\")\n"},
+			}
+			art := &attemptArtifacts{dir: t.TempDir()}
+			_, output, err := tryBazelFiles(ctx, r, wd, filepath.Join(wd, "a"), "//a/...", files, io.Discard, art)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if (output != "") != tc.wantOutput {
+				t.Errorf("output = %q", output)
+			}
+			got, _ := os.ReadFile(module)
+			_, buildErr := os.Stat(filepath.Join(wd, "a", "BUILD.bazel"))
+			if tc.wantKept {
+				if string(got) != files[0].Content || buildErr != nil {
+					t.Errorf("files not kept: MODULE.bazel %q, BUILD.bazel %v", got, buildErr)
+				}
+				return
+			}
+			if string(got) != "module(name = \"m\")\n" {
+				t.Errorf("MODULE.bazel = %q, want it restored", got)
+			}
+			if !os.IsNotExist(buildErr) {
+				t.Errorf("a/BUILD.bazel left behind: %v", buildErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ollamaClient talks to the native chat API of an Ollama server.
+type ollamaClient struct {
+	// baseURL is the server root, such as "http://localhost:11434";
+	// requests go to baseURL + "/api/chat".
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newOllamaClient(baseURL string) *ollamaClient {
+	return &ollamaClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+}
+
+// ollamaChatRequest is the body of an /api/chat request.
+type ollamaChatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+}
+
+// ollamaChatResponse is a reply of /api/chat or, when streaming, one line
+// of it. The token counts are set on the final, done, line.
+type ollamaChatResponse struct {
+	Model           string      `json:"model"`
+	Message         chatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+	Error           string      `json:"error"`
+}
+
+func (c *ollamaClient) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	body, err := json.Marshal(ollamaChatRequest{
+		Model: req.Model,
+		Messages: []chatMessage{
+			{Role: "system", Content: req.System},
+			{Role: "user", Content: string(req.Input)},
+		},
+		Stream: req.Stream != nil,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding chat request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating chat request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("chat request to %s failed: %w", c.baseURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		var or ollamaChatResponse
+		if json.Unmarshal(body, &or) == nil && or.Error != "" {
+			return nil, &apiError{StatusCode: resp.StatusCode, Message: or.Error, RetryAfter: retryAfter(resp)}
+		}
+		return nil, &apiError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body)), RetryAfter: retryAfter(resp)}
+	}
+
+	// Streamed replies are newline-delimited JSON; unstreamed replies are a
+	// single line of the same form.
+	var content strings.Builder
+	var last ollamaChatResponse
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var or ollamaChatResponse
+		if err := json.Unmarshal(sc.Bytes(), &or); err != nil {
+			return nil, fmt.Errorf("error parsing chat response: %w", err)
+		}
+		if or.Error != "" {
+			return nil, &apiError{Message: or.Error}
+		}
+		content.WriteString(or.Message.Content)
+		if req.Stream != nil && or.Message.Content != "" {
+			if _, err := io.WriteString(req.Stream, or.Message.Content); err != nil {
+				return nil, err
+			}
+		}
+		last = or
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading chat response: %w", err)
+	}
+	if !last.Done {
+		return nil, fmt.Errorf("chat response from %s ended early", c.baseURL)
+	}
+	return &completion{
+		Content: content.String(),
+		Usage: &chatUsage{
+			PromptTokens:     last.PromptEvalCount,
+			CompletionTokens: last.EvalCount,
+			TotalTokens:      last.PromptEvalCount + last.EvalCount,
+		},
+	}, nil
+}
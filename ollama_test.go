@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestOllama returns a client of an Ollama server served by handler,
+// which is passed the decoded request.
+func newTestOllama(t *testing.T, handler func(w http.ResponseWriter, req ollamaChatRequest)) *ollamaClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/chat" {
+			t.Errorf("%s %s", r.Method, r.URL.Path)
+		}
+		var req ollamaChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		handler(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	return newOllamaClient(srv.URL + "/")
+}
+
+func testCompletionRequest() completionRequest {
+	return completionRequest{Model: "qwen2.5-coder:7b", System: "prompt", Input: []byte("input")}
+}
+
+func TestOllama(t *testing.T) {
+	c := newTestOllama(t, func(w http.ResponseWriter, req ollamaChatRequest) {
+		want := ollamaChatRequest{
+			Model:    "qwen2.5-coder:7b",
+			Messages: []chatMessage{{Role: "system", Content: "prompt"}, {Role: "user", Content: "input"}},
+		}
+		if fmt.Sprint(req) != fmt.Sprint(want) {
+			t.Errorf("request = %+v, want %+v", req, want)
+		}
+		fmt.Fprint(w, `{"model":"qwen2.5-coder:7b","message":{"role":"assistant","content":"rust_library()"},"done":true,"prompt_eval_count":30,"eval_count":5}`+"\n")
+	})
+	comp, err := c.complete(context.Background(), testCompletionRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp.Content != "rust_library()" {
+		t.Errorf("content = %q", comp.Content)
+	}
+	if u := comp.Usage; u == nil || u.PromptTokens != 30 || u.CompletionTokens != 5 || u.TotalTokens != 35 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	c := newTestOllama(t, func(w http.ResponseWriter, req ollamaChatRequest) {
+		if !req.Stream {
+			t.Error("request is not streamed")
+		}
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"rust_"},"done":false}`+"\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"library()"},"done":false}`+"\n\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":30,"eval_count":5}`+"\n")
+	})
+	req := testCompletionRequest()
+	var stream strings.Builder
+	req.Stream = &stream
+	comp, err := c.complete(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp.Content != "rust_library()" || stream.String() != "rust_library()" {
+		t.Errorf("content %q, streamed %q", comp.Content, stream.String())
+	}
+	if u := comp.Usage; u == nil || u.CompletionTokens != 5 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestOllamaErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		body      string
+		want      *apiError
+		transient bool
+	}{
+		{
+			name:   "unknown model",
+			status: http.StatusNotFound,
+			body:   `{"error":"model \"qwen\" not found, try pulling it first"}`,
+			want:   &apiError{StatusCode: 404, Message: `model "qwen" not found, try pulling it first`},
+		},
+		{
+			name:      "plain text",
+			status:    http.StatusInternalServerError,
+			body:      "llama runner process has terminated\n",
+			want:      &apiError{StatusCode: 500, Message: "llama runner process has terminated"},
+			transient: true,
+		},
+		{
+			name:   "error in the reply",
+			status: http.StatusOK,
+			body:   `{"message":{"role":"assistant","content":"rust"},"done":false}` + "\n" + `{"error":"an unknown error was encountered"}` + "\n",
+			want:   &apiError{Message: "an unknown error was encountered"},
+		},
+		{
+			name:   "cut short",
+			status: http.StatusOK,
+			body:   `{"message":{"role":"assistant","content":"rust"},"done":false}` + "\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestOllama(t, func(w http.ResponseWriter, req ollamaChatRequest) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			})
+			_, err := c.complete(context.Background(), testCompletionRequest())
+			if err == nil {
+				t.Fatal("request succeeded")
+			}
+			if tc.want != nil {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) || *apiErr != *tc.want {
+					t.Fatalf("err = %#v, want %+v", err, *tc.want)
+				}
+			}
+			if got := isTransientLLMError(err); got != tc.transient {
+				t.Errorf("transient = %v, want %v", got, tc.transient)
+			}
+		})
+	}
+}
+
+func TestResolveProviderOllama(t *testing.T) {
+	cfg := defaultConfig()
+	p, provider, name, err := resolveProvider(nil, cfg, "ollama/qwen2.5-coder:7b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := p.(*ollamaClient); !ok || c.baseURL != "http://localhost:11434" || provider != "ollama" || name != "qwen2.5-coder:7b" {
+		t.Errorf("got %T %+v, provider %s, model %s", p, p, provider, name)
+	}
+}
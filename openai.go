@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAIClient talks to an OpenAI-compatible chat completions API, such as
+// OpenRouter's or that of a local inference server.
+type openAIClient struct {
+	// baseURL is the API root, such as "https://openrouter.ai/api/v1";
+	// requests go to baseURL + "/chat/completions".
+	baseURL string
+	// apiKey is sent as a bearer token unless empty.
+	apiKey     string
+	httpClient *http.Client
+}
+
+func newOpenAIClient(baseURL, apiKey string) *openAIClient {
+	return &openAIClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// chatMessage is one message of a conversation.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// ToolCalls are the tools an assistant message asks to call.
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	// ToolCallID names the call a "tool" message answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// chatRequest is the body of a chat completions request.
+type chatRequest struct {
+	Model         string         `json:"model"`
+	Messages      []chatMessage  `json:"messages"`
+	Tools         []chatTool     `json:"tools,omitempty"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+// chatTool describes a function the model may call.
+type chatTool struct {
+	Type     string       `json:"type"` // always "function"
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is the JSON schema of the function's arguments.
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// toolCall is a model's request to call a function.
+type toolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+		// Arguments is a JSON object, encoded as a string.
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatUsage is the token usage reported for a completion. Cost is only
+// reported by some providers, such as OpenRouter.
+type chatUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost,omitempty"`
+}
+
+// chatResponse is the result of a chat completions request. A streamed
+// response is assembled into the same form.
+type chatResponse struct {
+	ID      string       `json:"id"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int         `json:"index"`
+	Message      chatMessage `json:"message"`
+	Delta        chatMessage `json:"delta"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+// content returns the text of the first choice.
+func (r *chatResponse) content() string {
+	if len(r.Choices) == 0 {
+		return ""
+	}
+	return r.Choices[0].Message.Content
+}
+
+// apiError is an error reported by the API, either as an HTTP error status
+// or inside a streamed response.
+type apiError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Message    string
+	// RetryAfter is how long the server asked to wait before retrying,
+	// from its Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	var b strings.Builder
+	b.WriteString("API error")
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&b, " (HTTP %d)", e.StatusCode)
+	}
+	if e.Type != "" {
+		fmt.Fprintf(&b, " %s", e.Type)
+	}
+	if e.Code != "" {
+		fmt.Fprintf(&b, " [%s]", e.Code)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	return b.String()
+}
+
+// errorBody is the JSON form of an API error.
+type errorBody struct {
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		// Code is a string for OpenAI and a number for OpenRouter.
+		Code json.RawMessage `json:"code"`
+	} `json:"error"`
+}
+
+// apiErr returns the error in b, or nil if it holds none.
+func (b *errorBody) apiErr(statusCode int) *apiError {
+	if b.Error == nil {
+		return nil
+	}
+	return &apiError{
+		StatusCode: statusCode,
+		Type:       b.Error.Type,
+		Code:       strings.Trim(string(b.Error.Code), `"`),
+		Message:    b.Error.Message,
+	}
+}
+
+// newHTTPError builds the apiError of a response with an error status.
+func newHTTPError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var eb errorBody
+	if json.Unmarshal(body, &eb) == nil {
+		if e := eb.apiErr(resp.StatusCode); e != nil {
+			e.RetryAfter = retryAfter(resp)
+			return e
+		}
+	}
+	return &apiError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body)), RetryAfter: retryAfter(resp)}
+}
+
+// retryAfter returns the wait asked for by the Retry-After header of resp,
+// given in seconds or as a date, or 0 if there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// post sends req to the chat completions endpoint and returns the response
+// if its status is 200.
+func (c *openAIClient) post(ctx context.Context, req *chatRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding chat request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating chat request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.Stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("chat request to %s failed: %w", c.baseURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, newHTTPError(resp)
+	}
+	return resp, nil
+}
+
+// chat sends req and returns the complete response.
+func (c *openAIClient) chat(ctx context.Context, req chatRequest) (*chatResponse, error) {
+	req.Stream = false
+	req.StreamOptions = nil
+	resp, err := c.post(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading chat response: %w", err)
+	}
+	// Some providers report errors with a 200 status.
+	var eb errorBody
+	if json.Unmarshal(body, &eb) == nil {
+		if e := eb.apiErr(resp.StatusCode); e != nil {
+			return nil, e
+		}
+	}
+	var cr chatResponse
+	if err := json.Unmarshal(body, &cr); err != nil {
+		return nil, fmt.Errorf("error parsing chat response: %w", err)
+	}
+	if len(cr.Choices) == 0 {
+		return nil, fmt.Errorf("chat response has no choices")
+	}
+	return &cr, nil
+}
+
+// chatStream sends req as a streaming request, calling onDelta with each
+// piece of content as it arrives, and returns the assembled response. A
+// stream that ends before "data: [DONE]" was cut short, and fails with
+// io.ErrUnexpectedEOF.
+func (c *openAIClient) chatStream(ctx context.Context, req chatRequest, onDelta func(string) error) (*chatResponse, error) {
+	req.Stream = true
+	req.StreamOptions = &streamOptions{IncludeUsage: true}
+	resp, err := c.post(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	cr := &chatResponse{}
+	var content strings.Builder
+	var finishReason string
+	done := false
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		// Server-sent events: only "data:" lines matter here; lines
+		// starting with ':' are comments, such as OpenRouter's keep-alives.
+		data, ok := strings.CutPrefix(sc.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var eb errorBody
+		if json.Unmarshal([]byte(data), &eb) == nil {
+			if e := eb.apiErr(0); e != nil {
+				return nil, e
+			}
+		}
+		var chunk chatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("error parsing chat stream: %w", err)
+		}
+		if cr.ID == "" {
+			cr.ID, cr.Model = chunk.ID, chunk.Model
+		}
+		if chunk.Usage != nil {
+			cr.Usage = chunk.Usage
+		}
+		for _, ch := range chunk.Choices {
+			if ch.Index != 0 {
+				continue
+			}
+			if ch.FinishReason != "" {
+				finishReason = ch.FinishReason
+			}
+			if ch.Delta.Content == "" {
+				continue
+			}
+			content.WriteString(ch.Delta.Content)
+			if onDelta != nil {
+				if err := onDelta(ch.Delta.Content); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading chat stream: %w", err)
+	}
+	if !done {
+		return nil, fmt.Errorf("error reading chat stream: %w", io.ErrUnexpectedEOF)
+	}
+	cr.Choices = []chatChoice{{
+		Message:      chatMessage{Role: "assistant", Content: content.String()},
+		FinishReason: finishReason,
+	}}
+	return cr, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of an API served by handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *openAIClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return newOpenAIClient(srv.URL+"/v1/", "key")
+}
+
+func testChatRequest() chatRequest {
+	return chatRequest{Model: "m", Messages: []chatMessage{{Role: "user", Content: "hi"}}}
+}
+
+func TestChat(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.Model != "m" || req.Stream || req.StreamOptions != nil {
+			t.Errorf("request = %+v", req)
+		}
+		fmt.Fprint(w, `{"id":"x","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4,"cost":0.5}}`)
+	})
+	resp, err := c.chat(context.Background(), testChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.content() != "hello" {
+		t.Errorf("content = %q, want hello", resp.content())
+	}
+	if u := resp.Usage; u == nil || u.PromptTokens != 3 || u.CompletionTokens != 1 || u.Cost != 0.5 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestChatStream(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if !req.Stream || req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Errorf("request = %+v, want a stream with usage", req)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": OPENROUTER PROCESSING\n\n")
+		fmt.Fprint(w, "data: {\"id\":\"x\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hel\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"id\":\"x\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"id\":\"x\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+	var deltas []string
+	resp, err := c.chatStream(context.Background(), testChatRequest(), func(s string) error {
+		deltas = append(deltas, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.content() != "hello" || resp.Choices[0].FinishReason != "stop" {
+		t.Errorf("response = %+v", resp.Choices)
+	}
+	if strings.Join(deltas, "|") != "hel|lo" {
+		t.Errorf("deltas = %q", deltas)
+	}
+	if u := resp.Usage; u == nil || u.CompletionTokens != 2 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestChatStreamCutShort(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"id\":\"x\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hel\"}}]}\n\n")
+	})
+	_, err := c.chatStream(context.Background(), testChatRequest(), nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if !isTransientLLMError(err) {
+		t.Errorf("%v is not retried", err)
+	}
+}
+
+func TestChatErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		body      string
+		stream    bool
+		want      apiError
+		transient bool
+	}{
+		{
+			name:   "error status",
+			status: http.StatusBadRequest,
+			body:   `{"error":{"message":"bad model","type":"invalid_request_error","code":"model_not_found"}}`,
+			want:   apiError{StatusCode: 400, Type: "invalid_request_error", Code: "model_not_found", Message: "bad model"},
+		},
+		{
+			name:   "plain text",
+			status: http.StatusBadGateway,
+			body:   "upstream down\n",
+			want:   apiError{StatusCode: 502, Message: "upstream down"},
+			// Server errors are worth retrying.
+			transient: true,
+		},
+		{
+			name:   "error in a 200 response",
+			status: http.StatusOK,
+			body:   `{"error":{"message":"No endpoints found","code":404}}`,
+			want:   apiError{StatusCode: 200, Code: "404", Message: "No endpoints found"},
+		},
+		{
+			name:      "error in a stream",
+			status:    http.StatusOK,
+			body:      "data: {\"error\":{\"message\":\"Provider overloaded\",\"code\":502}}\n\n",
+			stream:    true,
+			want:      apiError{Code: "502", Message: "Provider overloaded"},
+			transient: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			})
+			var err error
+			if tc.stream {
+				_, err = c.chatStream(context.Background(), testChatRequest(), nil)
+			} else {
+				_, err = c.chat(context.Background(), testChatRequest())
+			}
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %v, want an apiError", err)
+			}
+			if *apiErr != tc.want {
+				t.Errorf("got %+v, want %+v", *apiErr, tc.want)
+			}
+			if got := isTransientLLMError(err); got != tc.transient {
+				t.Errorf("transient = %v, want %v", got, tc.transient)
+			}
+		})
+	}
+}
+
+func TestChatRetryAfter(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"Rate limit exceeded","code":429}}`)
+	})
+	_, err := c.chat(context.Background(), testChatRequest())
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 429 || apiErr.RetryAfter != 7*time.Second {
+		t.Fatalf("err = %#v, want HTTP 429 asking to retry after 7s", err)
+	}
+	if !isTransientLLMError(err) {
+		t.Errorf("%v is not retried", err)
+	}
+	rc := retryConfig{MaxRetries: 1, InitialDelay: time.Millisecond, MaxDelay: time.Minute}
+	if d := backoff(rc, 0, err); d != 7*time.Second {
+		t.Errorf("backoff = %s, want the 7s asked for", d)
+	}
+	rc.MaxDelay = 5 * time.Second
+	if d := backoff(rc, 0, err); d != 5*time.Second {
+		t.Errorf("backoff = %s, want MaxDelay", d)
+	}
+}
+
+func TestChatRetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}]}`)
+	})
+	rc := retryConfig{MaxRetries: 4, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	var resp *chatResponse
+	retries, err := retry(context.Background(), rc, "test request", isTransientLLMError, func() error {
+		var err error
+		resp, err = c.chat(context.Background(), testChatRequest())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries != 2 || resp.content() != "ok" {
+		t.Errorf("got %q after %d retries, want ok after 2", resp.content(), retries)
+	}
+
+	// Errors in the request are not retried.
+	requests.Store(0)
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, `{"error":{"message":"invalid key"}}`, http.StatusUnauthorized)
+	})
+	if _, err := retry(context.Background(), rc, "test request", isTransientLLMError, func() error {
+		_, err := c.chat(context.Background(), testChatRequest())
+		return err
+	}); err == nil {
+		t.Fatal("request with a bad key succeeded")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
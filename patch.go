@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// editBlock is one change to a file, from an aider-style SEARCH/REPLACE
+// block or a hunk of a unified diff: the lines in Search are replaced by
+// those in Replace.
+type editBlock struct {
+	// Path is slash-separated and relative to the workspace root.
+	Path    string
+	Search  []string
+	Replace []string
+	// Line is the line number at which a hunk expects Search, or 0 if
+	// unknown.
+	Line int
+	// Hunk is set for hunks of a diff, whose leading and trailing context
+	// lines may be dropped to make them apply, as patch(1) does.
+	Hunk bool
+}
+
+// maxFuzz is the number of context lines a hunk may lose at either end.
+const maxFuzz = 2
+
+var (
+	searchRE  = regexp.MustCompile(`^\s*<{5,9} SEARCH\s*$`)
+	dividerRE = regexp.MustCompile(`^\s*={5,9}\s*$`)
+	replaceRE = regexp.MustCompile(`^\s*>{5,9} REPLACE\s*$`)
+	hunkRE    = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+\d+(?:,\d+)? @@`)
+)
+
+// editFormatsPrompt is added to the system prompt of runLLM to let the model
+// answer with edits.
+const editFormatsPrompt = `If a file already exists, you may instead answer with edits to it, either as a unified diff or as SEARCH/REPLACE blocks like this one:
+
+path/to/BUILD.bazel
+<<<<<<< SEARCH
+the lines to replace, exactly as they are in the file
+=======
+the new lines
+>>>>>>> REPLACE`
+
+// replyFiles returns the Bazel files of an LLM reply: the whole files it
+// holds or, if it holds edits, the files of the worktree at dir with the
+// edits applied. Files are named as by parseBazelFiles.
+func replyFiles(dir, reply, defaultPath string) ([]bazelFile, error) {
+	if !hasEdits(reply) {
+		return parseBazelFiles(reply, defaultPath)
+	}
+	edits, err := parseEdits(reply, defaultPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(edits) == 0 {
+		return nil, errNoUsableContent
+	}
+	return applyEdits(dir, edits)
+}
+
+// hasEdits reports whether an LLM reply holds SEARCH/REPLACE blocks or a
+// unified diff rather than whole files.
+func hasEdits(reply string) bool {
+	for _, line := range strings.Split(reply, "\n") {
+		if searchRE.MatchString(line) || strings.HasPrefix(line, "+++ ") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEdits extracts the SEARCH/REPLACE blocks and diff hunks of an LLM
+// reply. A SEARCH/REPLACE block applies to the file named on the line before
+// it, or to defaultPath if that line names none.
+func parseEdits(reply, defaultPath string) ([]editBlock, error) {
+	lines := strings.Split(strings.ReplaceAll(reply, "\r\n", "\n"), "\n")
+	var edits []editBlock
+	// last is the last line that was neither blank nor a fence.
+	last := ""
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case searchRE.MatchString(line):
+			p := defaultPath
+			if name := fileNameRE.FindString(last); name != "" {
+				p = name
+				if !strings.Contains(p, "/") && p != "MODULE.bazel" && !strings.HasPrefix(p, "WORKSPACE") {
+					// A bare BUILD.bazel or .bzl file belongs next to
+					// defaultPath, as in parseBazelFiles.
+					p = path.Join(path.Dir(defaultPath), p)
+				}
+			} else if name := strings.Trim(strings.TrimSpace(last), "`*#: "); strings.Contains(name, "/") && !strings.ContainsAny(name, " \t") {
+				p = name
+			}
+			e := editBlock{Path: p}
+			j := i + 1
+			for ; j < len(lines) && !dividerRE.MatchString(lines[j]); j++ {
+				e.Search = append(e.Search, lines[j])
+			}
+			if j == len(lines) {
+				return nil, fmt.Errorf("SEARCH block for %s at line %d has no =======", p, i+1)
+			}
+			for j++; j < len(lines) && !replaceRE.MatchString(lines[j]); j++ {
+				e.Replace = append(e.Replace, lines[j])
+			}
+			if j == len(lines) {
+				return nil, fmt.Errorf("SEARCH block for %s at line %d has no >>>>>>> REPLACE", p, i+1)
+			}
+			edits = append(edits, e)
+			i, last = j, ""
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			hunks, n, err := parseFilePatch(lines[i:])
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, hunks...)
+			i, last = i+n-1, ""
+		default:
+			if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "```") {
+				last = line
+			}
+		}
+	}
+	return edits, nil
+}
+
+// parseFilePatch parses the diff of one file at the start of lines, from its
+// "---" line to the end of its last hunk, and returns its hunks and the
+// number of lines it spans. Line counts in hunk headers are ignored, since
+// models often get them wrong; a hunk ends at the first line that is not
+// part of it.
+func parseFilePatch(lines []string) ([]editBlock, int, error) {
+	oldPath, newPath := diffPath(lines[0][4:]), diffPath(lines[1][4:])
+	if newPath == "/dev/null" {
+		return nil, 0, fmt.Errorf("the diff deletes %s; files cannot be deleted", oldPath)
+	}
+	var hunks []editBlock
+	i := 2
+	for i < len(lines) {
+		m := hunkRE.FindStringSubmatch(lines[i])
+		if m == nil {
+			break
+		}
+		start, _ := strconv.Atoi(m[1])
+		h := editBlock{Path: newPath, Line: start, Hunk: true}
+	hunk:
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") {
+				break
+			}
+			if line == "" {
+				// A blank context line whose leading space was lost.
+				h.Search = append(h.Search, "")
+				h.Replace = append(h.Replace, "")
+				continue
+			}
+			switch line[0] {
+			case ' ':
+				h.Search = append(h.Search, line[1:])
+				h.Replace = append(h.Replace, line[1:])
+				continue
+			case '-':
+				h.Search = append(h.Search, line[1:])
+				continue
+			case '+':
+				h.Replace = append(h.Replace, line[1:])
+				continue
+			case '\\':
+				continue // "\ No newline at end of file"
+			}
+			break hunk
+		}
+		// Blank lines after the hunk, such as before a closing fence, are
+		// not context.
+		for len(h.Search) > 0 && len(h.Replace) > 0 && h.Search[len(h.Search)-1] == "" && h.Replace[len(h.Replace)-1] == "" && lines[i-1] == "" {
+			h.Search, h.Replace = h.Search[:len(h.Search)-1], h.Replace[:len(h.Replace)-1]
+			i--
+		}
+		hunks = append(hunks, h)
+	}
+	if len(hunks) == 0 {
+		return nil, 0, fmt.Errorf("the diff of %s has no hunks", newPath)
+	}
+	return hunks, i, nil
+}
+
+// diffPath returns the path named in a "---" or "+++" line without its
+// "a/" or "b/" prefix and trailing timestamp.
+func diffPath(s string) string {
+	s, _, _ = strings.Cut(s, "\t")
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return s
+	}
+	if strings.HasPrefix(s, "a/") || strings.HasPrefix(s, "b/") {
+		s = s[2:]
+	}
+	return s
+}
+
+// hunkError reports an edit that does not apply.
+type hunkError struct {
+	Path string
+	// N is the edit's position among the edits of the reply, from 1.
+	N      int
+	Hunk   bool
+	Search []string
+	Reason string
+}
+
+func (e *hunkError) Error() string {
+	kind := "SEARCH/REPLACE block"
+	if e.Hunk {
+		kind = "hunk"
+	}
+	msg := fmt.Sprintf("%s: %s %d does not apply: %s", e.Path, kind, e.N, e.Reason)
+	if len(e.Search) > 0 {
+		msg += "; it looks for:\n" + strings.Join(e.Search, "\n")
+	}
+	return msg
+}
+
+// applyEdits applies edits to the files they name in the worktree at dir
+// and returns the edited files, without writing them. Only Bazel files may
+// be edited; a file that does not exist is created by an edit with nothing
+// to search for. Every edit that does not apply is reported.
+func applyEdits(dir string, edits []editBlock) ([]bazelFile, error) {
+	var files []bazelFile
+	index := make(map[string]int)
+	var errs []error
+	for n, e := range edits {
+		p := path.Clean(e.Path)
+		if !filepath.IsLocal(filepath.FromSlash(p)) || !isBazelFileName(path.Base(p)) {
+			errs = append(errs, &hunkError{Path: e.Path, N: n + 1, Hunk: e.Hunk, Reason: "only Bazel files in the workspace may be edited"})
+			continue
+		}
+		i, ok := index[p]
+		if !ok {
+			content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("error reading %s: %w", p, err)
+			}
+			i = len(files)
+			index[p] = i
+			files = append(files, bazelFile{Path: p, Content: string(content)})
+		}
+		content, reason := applyEdit(files[i].Content, e)
+		if reason != "" && files[i].Content == "" {
+			reason = "the file does not exist or is empty"
+		}
+		if reason != "" {
+			errs = append(errs, &hunkError{Path: p, N: n + 1, Hunk: e.Hunk, Search: e.Search, Reason: reason})
+			continue
+		}
+		files[i].Content = content
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// applyEdit applies e to content. It returns why e does not apply if it
+// does not.
+func applyEdit(content string, e editBlock) (string, string) {
+	search, replace := e.Search, e.Replace
+	if !e.Hunk {
+		search = trimBlankEnds(search)
+	}
+	if len(search) == 0 {
+		if strings.TrimSpace(content) != "" {
+			return "", "nothing to search for, but the file is not empty"
+		}
+		return joinLines(replace), ""
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	// Drop the context lines around a hunk one at a time, as long as some
+	// context remains.
+	for fuzz := 0; fuzz <= maxFuzz; fuzz++ {
+		s, r := search, replace
+		if fuzz > 0 {
+			if !e.Hunk || len(s) <= 2*fuzz {
+				break
+			}
+			lead, trail := contextLines(s, r)
+			if lead < fuzz && trail < fuzz {
+				break
+			}
+			front, back := min(lead, fuzz), min(trail, fuzz)
+			s, r = s[front:len(s)-back], r[front:len(r)-back]
+		}
+		if at, ok := findLines(lines, s, e.Line); ok {
+			out := append(append(append([]string(nil), lines[:at]...), r...), lines[at+len(s):]...)
+			return joinLines(out), ""
+		}
+	}
+	if at := findLine(lines, search[0]); at >= 0 {
+		return "", fmt.Sprintf("its first line matches line %d, but the lines after it differ", at+1)
+	}
+	return "", "no lines match"
+}
+
+// findLines returns where want occurs in lines, exactly or else ignoring
+// indentation and trailing whitespace. Of several occurrences it picks the
+// one nearest line near, counted from 1, or the first if near is 0.
+func findLines(lines, want []string, near int) (int, bool) {
+	for _, eq := range []func(a, b string) bool{
+		func(a, b string) bool { return a == b },
+		func(a, b string) bool { return strings.TrimSpace(a) == strings.TrimSpace(b) },
+	} {
+		best := -1
+		for at := 0; at+len(want) <= len(lines); at++ {
+			match := true
+			for j, w := range want {
+				if !eq(lines[at+j], w) {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			if best < 0 || near > 0 && abs(at+1-near) < abs(best+1-near) {
+				best = at
+			}
+			if near == 0 {
+				break
+			}
+		}
+		if best >= 0 {
+			return best, true
+		}
+	}
+	return 0, false
+}
+
+// findLine returns the index of the first of lines equal to want ignoring
+// surrounding whitespace, or -1.
+func findLine(lines []string, want string) int {
+	for i, l := range lines {
+		if strings.TrimSpace(l) == strings.TrimSpace(want) && strings.TrimSpace(want) != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// contextLines returns the number of lines search and replace share at
+// their start and at their end.
+func contextLines(search, replace []string) (lead, trail int) {
+	for lead < len(search) && lead < len(replace) && search[lead] == replace[lead] {
+		lead++
+	}
+	for trail < len(search)-lead && trail < len(replace)-lead && search[len(search)-1-trail] == replace[len(replace)-1-trail] {
+		trail++
+	}
+	return lead, trail
+}
+
+// trimBlankEnds drops the blank lines at either end of lines.
+func trimBlankEnds(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyEdit(t *testing.T) {
+	const file = `load("@rules_rust//rust:defs.bzl", "rust_library")
+
+rust_library(
+    name = "a",
+    srcs = ["src/lib.rs"],
+)
+
+rust_library(
+    name = "b",
+    srcs = ["src/lib.rs"],
+)
+`
+	lines := func(s string) []string { return strings.Split(s, "\n") }
+	for _, tc := range []struct {
+		name       string
+		content    string
+		edit       editBlock
+		want       string
+		wantReason string
+	}{
+		{
+			name:    "exact",
+			content: file,
+			edit: editBlock{
+				Search:  lines(`    name = "a",`),
+				Replace: lines(`    name = "c",`),
+			},
+			want: strings.Replace(file, `"a"`, `"c"`, 1),
+		},
+		{
+			name:    "indentation ignored",
+			content: file,
+			edit: editBlock{
+				Search:  lines("rust_library(\nname = \"b\",\n  srcs = [\"src/lib.rs\"],   "),
+				Replace: lines("rust_library(\n    name = \"b\",\n    srcs = [\"src/b.rs\"],"),
+			},
+			want: strings.Replace(file, "\"b\",\n    srcs = [\"src/lib.rs\"]", "\"b\",\n    srcs = [\"src/b.rs\"]", 1),
+		},
+		{
+			name:    "blank lines around a block ignored",
+			content: file,
+			edit: editBlock{
+				Search:  lines("\n    name = \"a\",\n"),
+				Replace: lines(`    name = "c",`),
+			},
+			want: strings.Replace(file, `"a"`, `"c"`, 1),
+		},
+		{
+			name:    "hunk near its line",
+			content: file,
+			edit: editBlock{
+				Search:  lines(`    srcs = ["src/lib.rs"],`),
+				Replace: lines(`    srcs = ["src/b.rs"],`),
+				Line:    10,
+				Hunk:    true,
+			},
+			want: file[:strings.LastIndex(file, "src/lib.rs")] + "src/b.rs" + file[strings.LastIndex(file, "src/lib.rs")+len("src/lib.rs"):],
+		},
+		{
+			name:    "hunk with a wrong leading context line",
+			content: file,
+			edit: editBlock{
+				Search:  lines("    # the first library\n    srcs = [\"src/lib.rs\"],\n)\n"),
+				Replace: lines("    # the first library\n    srcs = [\"src/x.rs\"],\n)\n"),
+				Line:    4,
+				Hunk:    true,
+			},
+			want: strings.Replace(file, "\"a\",\n    srcs = [\"src/lib.rs\"]", "\"a\",\n    srcs = [\"src/x.rs\"]", 1),
+		},
+		{
+			name:    "hunk whose trailing context is missing from the file",
+			content: file,
+			edit: editBlock{
+				Search:  lines("    name = \"b\",\n    srcs = [\"src/lib.rs\"],\n    visibility = [\"//visibility:public\"],"),
+				Replace: lines("    name = \"b\",\n    srcs = [\"src/b.rs\"],\n    visibility = [\"//visibility:public\"],"),
+				Line:    9,
+				Hunk:    true,
+			},
+			want: strings.Replace(file, "\"b\",\n    srcs = [\"src/lib.rs\"]", "\"b\",\n    srcs = [\"src/b.rs\"]", 1),
+		},
+		{
+			name:    "SEARCH/REPLACE blocks get no fuzz",
+			content: file,
+			edit: editBlock{
+				Search:  lines("rust_library(\n    name = \"x\",\n    srcs = [\"src/lib.rs\"],\n)"),
+				Replace: lines("rust_library(\n    name = \"x\",\n    srcs = [\"src/x.rs\"],\n)"),
+			},
+			wantReason: "its first line matches line 3, but the lines after it differ",
+		},
+		{
+			name:    "hunk with too little context left",
+			content: file,
+			edit: editBlock{
+				Search:  lines("name = \"x\",\nsrcs = [\"src/lib.rs\"],"),
+				Replace: lines("name = \"x\",\nsrcs = [\"src/x.rs\"],"),
+				Hunk:    true,
+			},
+			wantReason: "no lines match",
+		},
+		{
+			name:    "new file",
+			content: "",
+			edit:    editBlock{Replace: lines(`rust_library(name = "a")`)},
+			want:    "rust_library(name = \"a\")\n",
+		},
+		{
+			name:       "nothing to search for in an existing file",
+			content:    file,
+			edit:       editBlock{Replace: lines(`rust_library(name = "a")`)},
+			wantReason: "nothing to search for, but the file is not empty",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, reason := applyEdit(tc.content, tc.edit)
+			if reason != tc.wantReason {
+				t.Fatalf("reason = %q, want %q", reason, tc.wantReason)
+			}
+			if got != tc.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplyFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "crates", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	build := "rust_library(\n    name = \"a\",\n)\n"
+	if err := os.WriteFile(filepath.Join(dir, "crates", "a", "BUILD.bazel"), []byte(build), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := "rust_library(\n    name = \"b\",\n)\n"
+	for _, tc := range []struct {
+		name    string
+		reply   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "whole file",
+			reply: "```starlark\n" + want + "```\n",
+			want:  want,
+		},
+		{
+			name:  "SEARCH/REPLACE",
+			reply: "BUILD.bazel\n```\n<<<<<<< SEARCH\n    name = \"a\",\n=======\n    name = \"b\",\n>>>>>>> REPLACE\n```\n",
+			want:  want,
+		},
+		{
+			name:  "diff",
+			reply: "```diff\n--- a/crates/a/BUILD.bazel\n+++ b/crates/a/BUILD.bazel\n@@ -1,3 +1,3 @@\n rust_library(\n-    name = \"a\",\n+    name = \"b\",\n )\n```\n",
+			want:  want,
+		},
+		{
+			name:    "diff header without hunks",
+			reply:   "I changed it:\n+++ everything\n",
+			wantErr: errNoUsableContent,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := replyFiles(dir, tc.reply, "crates/a/BUILD.bazel")
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Path != "crates/a/BUILD.bazel" || files[0].Content != tc.want {
+				t.Errorf("got %+v", files)
+			}
+		})
+	}
+}
+
+func TestApplyEditsReportsEveryFailure(t *testing.T) {
+	edits := []editBlock{
+		{Path: "src/main.rs", Replace: []string{"fn main() {}"}},
+		{Path: "../BUILD.bazel", Replace: []string{"x"}},
+		{Path: "a/BUILD.bazel", Search: []string{"missing"}, Replace: []string{"x"}},
+	}
+	_, err := applyEdits(t.TempDir(), edits)
+	if err == nil {
+		t.Fatal("edits applied")
+	}
+	for _, want := range []string{
+		"src/main.rs: SEARCH/REPLACE block 1 does not apply: only Bazel files",
+		"../BUILD.bazel: SEARCH/REPLACE block 2 does not apply: only Bazel files",
+		"a/BUILD.bazel: SEARCH/REPLACE block 3 does not apply: the file does not exist or is empty",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not report %q:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+)
+
+// planCommand is a command the matrix runner would run.
+type planCommand struct {
+	Dir  string   `json:"dir"`
+	Argv []string `json:"argv"`
+}
+
+func newPlanCommand(c *command) planCommand {
+	return planCommand{Dir: c.Dir, Argv: append([]string{c.Name}, c.Args...)}
+}
+
+// matrixPlan describes what "bld matrix" would do without doing it.
+type matrixPlan struct {
+	Repo          string      `json:"repo"`
+	Branch        string      `json:"branch"`
+	WorktreeDir   string      `json:"worktree_dir"`
+	MaxAttempts   int         `json:"max_attempts"`
+	PromptVariant string      `json:"prompt_variant"`
+	Agent         string      `json:"agent"`
+	Models        []modelPlan `json:"models"`
+}
+
+// modelPlan is the part of a matrixPlan for one model.
+type modelPlan struct {
+	Model    string `json:"model"`
+	Branch   string `json:"branch"`
+	Worktree string `json:"worktree"`
+	// CreateBranch and AddWorktree hold the commands creating the model's
+	// branch and worktree; they are nil when those already exist.
+	CreateBranch *planCommand `json:"create_branch,omitempty"`
+	AddWorktree  *planCommand `json:"add_worktree,omitempty"`
+	Targets      []targetPlan `json:"targets"`
+}
+
+// targetPlan is the part of a modelPlan for one target.
+type targetPlan struct {
+	Target string `json:"target"`
+	// Placeholder is the BUILD.bazel file that would be created before
+	// aider runs, relative to the worktree; empty if it already exists.
+	Placeholder string `json:"placeholder,omitempty"`
+	// PreCheck runs first; if every command succeeds no attempt is made.
+	PreCheck []planCommand `json:"pre_check"`
+	// Attempt runs up to MaxAttempts times, after the native agent or the
+	// one-shot request if that is the agent, followed by OnFailure after a
+	// failed attempt and by OnSuccess after the first successful one. The
+	// files its git diff lists, committed or not, and the untracked ones are
+	// checked against policy.allowed_files; the Bazel files among them are
+	// formatted, and the attempt fails if they do not parse. OnFailure keeps
+	// the failed attempt's changes on a ref of their own before discarding
+	// them.
+	Attempt   []planCommand `json:"attempt"`
+	OnFailure []planCommand `json:"on_failure"`
+	OnSuccess []planCommand `json:"on_success"`
+}
+
+// planMatrix works out the branches, worktrees, placeholder BUILD.bazel
+// files and commands "bld matrix" would use. It only runs read-only commands.
+func planMatrix(ctx context.Context, r runner, cfg *config, prompts *promptSet, branch, worktreeBaseDir string, targets []string) (*matrixPlan, error) {
+	p := &matrixPlan{
+		Repo:          cfg.Repo,
+		Branch:        branch,
+		WorktreeDir:   worktreeBaseDir,
+		MaxAttempts:   cfg.MaxAttempts,
+		PromptVariant: prompts.variant,
+		Agent:         cfg.Agent,
+	}
+	for _, model := range cfg.Models {
+		modelBranch, worktreePath := modelWorktree(branch, worktreeBaseDir, model)
+		mp := modelPlan{Model: model, Branch: modelBranch, Worktree: worktreePath}
+
+		branchExists, err := gitBranchExists(ctx, r, cfg.Repo, modelBranch)
+		if err != nil {
+			return nil, err
+		}
+		if !branchExists {
+			c := newPlanCommand(newGitBranchCommand(cfg.Repo, modelBranch))
+			mp.CreateBranch = &c
+		}
+		worktreeExists, err := gitWorktreeExists(worktreePath)
+		if err != nil {
+			return nil, err
+		}
+		if !worktreeExists {
+			c := newPlanCommand(newGitWorktreeAddCommand(cfg.Repo, worktreePath, modelBranch))
+			mp.AddWorktree = &c
+		}
+
+		placeholders := make(map[string]bool)
+		for _, target := range targets {
+			buildFile, _ := targetBuildFile(target)
+			// The first attempt's message; later ones add why the
+			// previous attempt was rejected.
+			message, err := prompts.render(promptAider, promptData{Target: target, PackageDir: packageDir(target)})
+			if err != nil {
+				return nil, err
+			}
+			tp := targetPlan{
+				Target: target,
+				PreCheck: []planCommand{
+					newPlanCommand(newBazelQueryCommand(worktreePath, target)),
+					newPlanCommand(newBazelBuildCommand(worktreePath, target)),
+				},
+				Attempt: []planCommand{
+					newPlanCommand(newCommand(worktreePath, "git", "diff", "--name-only", "--no-renames", "-z", "HEAD", "--")),
+					newPlanCommand(newBazelQueryCommand(worktreePath, target)),
+					newPlanCommand(newBazelBuildCommand(worktreePath, target)),
+				},
+				OnFailure: []planCommand{
+					newPlanCommand(newGitUpdateRefCommand(worktreePath, attemptRef("<run-id>", model, target, "<attempt>"), "<commit of the worktree>")),
+				},
+				OnSuccess: []planCommand{
+					newPlanCommand(newCommand(worktreePath, "git", "add", "-A")),
+					newPlanCommand(newGitCommitCommand(worktreePath, matrixCommitMessage(cfg.Agent, model, target))),
+				},
+			}
+			for _, c := range newGitDiscardCommands(worktreePath) {
+				tp.OnFailure = append(tp.OnFailure, newPlanCommand(c))
+			}
+			if cfg.Agent == agentAider {
+				tp.Attempt = slices.Insert(tp.Attempt, 0, newPlanCommand(newAiderCommand(worktreePath, model, target, buildFile, message)))
+			}
+			if buildFile != "" && !placeholders[buildFile] {
+				exists, err := planBuildFileExists(ctx, r, cfg.Repo, worktreePath, modelBranch, branchExists, worktreeExists, buildFile)
+				if err != nil {
+					return nil, err
+				}
+				if !exists {
+					tp.Placeholder = buildFile
+					placeholders[buildFile] = true
+				}
+			}
+			mp.Targets = append(mp.Targets, tp)
+		}
+		p.Models = append(p.Models, mp)
+	}
+	return p, nil
+}
+
+// planBuildFileExists reports whether buildFile would already exist in the
+// model's worktree. Worktrees that do not exist yet are checked out from the
+// model's branch or, if that does not exist either, from HEAD.
+func planBuildFileExists(ctx context.Context, r runner, repo, worktreePath, modelBranch string, branchExists, worktreeExists bool, buildFile string) (bool, error) {
+	if worktreeExists {
+		return gitWorktreeExists(filepath.Join(worktreePath, buildFile))
+	}
+	rev := "HEAD"
+	if branchExists {
+		rev = modelBranch
+	}
+	return gitFileExists(ctx, r, repo, rev, buildFile)
+}
+
+// writeText prints p for people to read.
+func (p *matrixPlan) writeText(w io.Writer) error {
+	pw := &planWriter{w: w}
+	pw.printf("Plan for %s (branch %s); worktrees under %s; prompt variant %s; agent %s\n", p.Repo, p.Branch, p.WorktreeDir, p.PromptVariant, p.Agent)
+	for _, mp := range p.Models {
+		pw.printf("\nmodel %s\n", mp.Model)
+		if mp.CreateBranch != nil {
+			pw.printf("  create branch %s\n", mp.Branch)
+			pw.command("    ", *mp.CreateBranch)
+		} else {
+			pw.printf("  use existing branch %s\n", mp.Branch)
+		}
+		if mp.AddWorktree != nil {
+			pw.printf("  add worktree %s\n", mp.Worktree)
+			pw.command("    ", *mp.AddWorktree)
+		} else {
+			pw.printf("  use existing worktree %s\n", mp.Worktree)
+		}
+		for _, tp := range mp.Targets {
+			pw.printf("  target %s\n", tp.Target)
+			if tp.Placeholder != "" {
+				pw.printf("    write placeholder %s\n", tp.Placeholder)
+			}
+			pw.printf("    pre-check (skip the target if these succeed):\n")
+			pw.commands("      ", tp.PreCheck)
+			switch p.Agent {
+			case agentNative:
+				pw.printf("    each of up to %d attempts, after the native agent edits the Bazel files:\n", p.MaxAttempts)
+			case agentOneShot:
+				pw.printf("    each of up to %d attempts, after the model's reply is applied to the Bazel files:\n", p.MaxAttempts)
+			default:
+				pw.printf("    each of up to %d attempts:\n", p.MaxAttempts)
+			}
+			pw.commands("      ", tp.Attempt)
+			pw.printf("    after a failed attempt:\n")
+			pw.commands("      ", tp.OnFailure)
+			pw.printf("    after a successful attempt:\n")
+			pw.commands("      ", tp.OnSuccess)
+		}
+	}
+	return pw.err
+}
+
+// writeJSON prints p as indented JSON.
+func (p *matrixPlan) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// planWriter remembers the first write error so writeText can check once.
+type planWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *planWriter) printf(format string, args ...any) {
+	if pw.err == nil {
+		_, pw.err = fmt.Fprintf(pw.w, format, args...)
+	}
+}
+
+func (pw *planWriter) command(indent string, c planCommand) {
+	cmd := &command{Name: c.Argv[0], Args: c.Argv[1:]}
+	pw.printf("%s$ %s\n", indent, cmd)
+}
+
+func (pw *planWriter) commands(indent string, cs []planCommand) {
+	for _, c := range cs {
+		pw.command(indent, c)
+	}
+}
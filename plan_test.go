@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPlanMatrix(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Repo = "/repo"
+	cfg.Models = []string{"org/m"}
+	cfg.MaxAttempts = 2
+	prompts, err := loadPrompts(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither the branch nor the BUILD.bazel of the first target exist; the
+	// second target's package has one.
+	r := &recordingRunner{Respond: func(c *command) (*result, error) {
+		switch {
+		case slices.Contains(c.Args, "show-ref"):
+			return exitError(1)
+		case slices.Contains(c.Args, "HEAD:crates/a/BUILD.bazel"):
+			return exitError(128)
+		}
+		return &result{}, nil
+	}}
+	base := t.TempDir()
+	p, err := planMatrix(context.Background(), r, cfg, prompts, "main", base, []string{"//crates/a:a", "//crates/b:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []string
+	for _, c := range r.Commands {
+		ran = append(ran, c.String())
+	}
+	want := []string{
+		"git show-ref --verify --quiet refs/heads/main-org-m",
+		"git cat-file -e HEAD:crates/a/BUILD.bazel",
+		"git cat-file -e HEAD:crates/b/BUILD.bazel",
+	}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %q, want only the read-only %q", ran, want)
+	}
+
+	if len(p.Models) != 1 {
+		t.Fatalf("got %d model plans, want 1", len(p.Models))
+	}
+	mp := p.Models[0]
+	worktree := filepath.Join(base, "main-org-m")
+	if mp.Branch != "main-org-m" || mp.Worktree != worktree {
+		t.Errorf("branch %s worktree %s, want main-org-m %s", mp.Branch, mp.Worktree, worktree)
+	}
+	if mp.CreateBranch == nil || !slices.Equal(mp.CreateBranch.Argv, []string{"git", "branch", "main-org-m"}) {
+		t.Errorf("CreateBranch = %v, want git branch main-org-m", mp.CreateBranch)
+	}
+	if mp.AddWorktree == nil || !slices.Equal(mp.AddWorktree.Argv, []string{"git", "worktree", "add", worktree, "main-org-m"}) {
+		t.Errorf("AddWorktree = %v, want git worktree add", mp.AddWorktree)
+	}
+	if len(mp.Targets) != 2 {
+		t.Fatalf("got %d target plans, want 2", len(mp.Targets))
+	}
+	a, b := mp.Targets[0], mp.Targets[1]
+	if a.Placeholder != "crates/a/BUILD.bazel" || b.Placeholder != "" {
+		t.Errorf("placeholders %q and %q, want crates/a/BUILD.bazel and none", a.Placeholder, b.Placeholder)
+	}
+	if got := a.Attempt[0].Argv; got[0] != "aider" || a.Attempt[0].Dir != worktree {
+		t.Errorf("first attempt command %q in %s, want aider in %s", got, a.Attempt[0].Dir, worktree)
+	}
+	if got := a.OnFailure[0].Argv; !slices.Contains(got, "refs/bld/<run-id>/org-m/crates-a-a/<attempt>") {
+		t.Errorf("OnFailure starts with %q, want the update of the attempt's ref", got)
+	}
+	if got := a.OnSuccess[1].Argv; !slices.Equal(got, []string{"git", "commit", "-m", "aider: model org/m target //crates/a:a"}) {
+		t.Errorf("OnSuccess commits with %q", got)
+	}
+
+	// -plan-format json prints the same plan.
+	var out strings.Builder
+	if err := p.writeJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded matrixPlan
+	if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, p) {
+		t.Errorf("JSON plan decodes to %+v, want %+v", &decoded, p)
+	}
+}
+
+func TestPlanMatrixAgents(t *testing.T) {
+	for _, agent := range []string{agentNative, agentOneShot} {
+		cfg := defaultConfig()
+		cfg.Repo = "/repo"
+		cfg.Models = []string{"m"}
+		cfg.Agent = agent
+		prompts, err := loadPrompts(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := planMatrix(context.Background(), &recordingRunner{}, cfg, prompts, "main", t.TempDir(), []string{"//crates/a:a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range p.Models[0].Targets[0].Attempt {
+			if c.Argv[0] == "aider" {
+				t.Errorf("agent %s: attempt runs aider", agent)
+			}
+		}
+		var text strings.Builder
+		if err := p.writeText(&text); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text.String(), "agent "+agent) {
+			t.Errorf("agent %s: plan does not name the agent:\n%s", agent, text.String())
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// Actions on an attempt that changes files the policy does not allow, the
+// values of policy.on_violation.
+const (
+	policyReject = "reject" // fail the attempt
+	policyRevert = "revert" // restore the files and go on with the rest
+)
+
+// policyConfig restricts the files the matrix runner's attempts may change.
+type policyConfig struct {
+	// AllowedFiles are path.Match patterns of the files an attempt may
+	// change. Patterns without a slash match base names and others match
+	// paths relative to the workspace root.
+	AllowedFiles []string `toml:"allowed_files"`
+	// OnViolation is "reject" or "revert".
+	OnViolation string `toml:"on_violation"`
+}
+
+// allows reports whether the policy lets an attempt change the file at rel,
+// a slash-separated path relative to the workspace root.
+func (p *policyConfig) allows(rel string) bool {
+	for _, pattern := range p.AllowedFiles {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// policyViolations returns the files changed in the worktree at dir since
+// rev, committed or not, that p does not allow. Bazel's convenience symlinks
+// are excluded by gitExcludeBazelSymlinks and so not seen as changes.
+func policyViolations(ctx context.Context, r runner, dir, rev string, p policyConfig) ([]string, error) {
+	changed, err := gitChangedSince(ctx, r, dir, rev)
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	for _, f := range changed {
+		if p.allows(f) {
+			continue
+		}
+		violations = append(violations, f)
+	}
+	return violations, nil
+}
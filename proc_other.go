@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// setProcessGroup only bounds how long cancellation waits for cmd on
+// platforms without process groups; see proc_unix.go.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) {
+	cmd.WaitDelay = grace
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup runs cmd in a process group of its own and makes
+// cancellation terminate the whole group: aider and bazel start children
+// that would otherwise outlive them. The group is sent SIGTERM first and
+// SIGKILL if it is still running after grace.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		time.AfterFunc(grace, func() { syscall.Kill(pgid, syscall.SIGKILL) })
+		return syscall.Kill(pgid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 2 * grace
+}
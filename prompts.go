@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// builtinPrompts holds the prompt variants shipped with bld, one directory
+// per variant.
+//
+//go:embed prompts
+var builtinPrompts embed.FS
+
+// Prompt template names. Each variant has one file per name, with the
+// suffix ".tmpl".
+const (
+	promptAider     = "aider"      // the aider --message of the matrix runner
+	promptMigrate   = "migrate"    // the system prompt of the migrator
+	promptBuildFile = "build_file" // the system prompt of runLLM
+)
+
+var promptNames = []string{promptAider, promptMigrate, promptBuildFile}
+
+// promptData holds the variables available to prompt templates. Fields
+// that do not apply to a prompt are empty.
+type promptData struct {
+	// Crate is the name of the crate being migrated.
+	Crate string
+	// Target is the Bazel label being migrated, such as "//crates/cli:grep_cli".
+	Target string
+	// PackageDir is the directory of the crate or target's package,
+	// relative to the workspace root.
+	PackageDir string
+	// PreviousError says why the previous attempt failed; it is empty on
+	// the first attempt.
+	PreviousError string
+	// CargoToml is the content of the crate's Cargo.toml.
+	CargoToml string
+}
+
+// promptSet is a variant's parsed prompt templates.
+type promptSet struct {
+	variant   string
+	templates *template.Template
+}
+
+// loadPrompts parses the templates of the variant named by cfg. A variant is
+// a directory of templates, either in prompts.dir or built into bld. When
+// both have a variant of the name, the templates in prompts.dir replace the
+// built-in ones and any they lack are taken from the built-in variant.
+func loadPrompts(cfg *config) (*promptSet, error) {
+	variant := cfg.Prompts.Variant
+	var sources []fs.FS
+	if hasDir(builtinPrompts, "prompts/"+variant) {
+		sub, err := fs.Sub(builtinPrompts, "prompts/"+variant)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, sub)
+	}
+	if cfg.Prompts.Dir != "" {
+		dir := filepath.Join(cfg.Prompts.Dir, variant)
+		if _, err := os.Stat(dir); err == nil {
+			sources = append(sources, os.DirFS(dir))
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading prompt variant %s: %w", variant, err)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("unknown prompt variant %q", variant)
+	}
+
+	t := template.New(variant).Option("missingkey=error")
+	for _, name := range promptNames {
+		// Later sources override earlier ones.
+		var text []byte
+		for _, src := range sources {
+			data, err := fs.ReadFile(src, name+".tmpl")
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error reading prompt %s/%s: %w", variant, name, err)
+			}
+			text = data
+		}
+		if text == nil {
+			return nil, fmt.Errorf("prompt variant %s has no %s.tmpl", variant, name)
+		}
+		if _, err := t.New(name).Parse(string(text)); err != nil {
+			return nil, fmt.Errorf("error parsing prompt %s/%s: %w", variant, name, err)
+		}
+	}
+	return &promptSet{variant: variant, templates: t}, nil
+}
+
+// promptVariants returns the names of the available variants.
+func promptVariants(cfg *config) []string {
+	var names []string
+	entries, _ := builtinPrompts.ReadDir("prompts")
+	if cfg.Prompts.Dir != "" {
+		more, _ := os.ReadDir(cfg.Prompts.Dir)
+		entries = append(entries, more...)
+	}
+	for _, e := range entries {
+		if e.IsDir() && !slices.Contains(names, e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func hasDir(fsys fs.FS, name string) bool {
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.IsDir()
+}
+
+// render executes the named template with data.
+func (p *promptSet) render(name string, data promptData) (string, error) {
+	var b bytes.Buffer
+	if err := p.templates.ExecuteTemplate(&b, name, data); err != nil {
+		return "", fmt.Errorf("error rendering prompt %s/%s: %w", p.variant, name, err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// packageDir returns the package directory of a label, such as
+// "crates/cli" for "//crates/cli:grep_cli".
+func packageDir(target string) string {
+	pkg, _, _ := strings.Cut(strings.TrimPrefix(target, "//"), ":")
+	return path.Clean("./" + pkg)
+}
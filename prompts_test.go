@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinPrompts(t *testing.T) {
+	cfg := defaultConfig()
+	variants := promptVariants(cfg)
+	if !slices.Equal(variants, []string{"default", "rules_rust"}) {
+		t.Errorf("variants = %q", variants)
+	}
+	data := promptData{
+		Crate:      "grep_cli",
+		Target:     "//crates/cli:grep_cli",
+		PackageDir: "crates/cli",
+		CargoToml:  "[package]\nname = \"grep-cli\"\n",
+	}
+	for _, variant := range variants {
+		cfg.Prompts.Variant = variant
+		p, err := loadPrompts(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range promptNames {
+			for _, previousError := range []string{"", "ERROR: no such package"} {
+				data.PreviousError = previousError
+				s, err := p.render(name, data)
+				if err != nil {
+					t.Errorf("%s/%s: %v", variant, name, err)
+					continue
+				}
+				if s == "" || strings.Contains(s, "{{") || strings.Contains(s, "<no value>") {
+					t.Errorf("%s/%s rendered as %q", variant, name, s)
+				}
+				if !strings.Contains(s, "crates/cli") && !strings.Contains(s, "grep_cli") {
+					t.Errorf("%s/%s names neither the package nor the crate:\n%s", variant, name, s)
+				}
+				if strings.Contains(s, "ERROR: no such package") != (previousError != "") {
+					t.Errorf("%s/%s with previous error %q:\n%s", variant, name, previousError, s)
+				}
+			}
+		}
+	}
+
+	cfg.Prompts.Variant = "none"
+	if _, err := loadPrompts(cfg); err == nil {
+		t.Error("loaded an unknown variant")
+	}
+}
+
+func TestPromptsDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A new variant, complete, and an override of one built-in template.
+	write("terse/aider.tmpl", "Build {{.Target}}.")
+	write("terse/migrate.tmpl", "BUILD.bazel for {{.Crate}}.")
+	write("terse/build_file.tmpl", "BUILD.bazel in {{.PackageDir}}.")
+	write("default/aider.tmpl", "Make {{.Target}} build, please.")
+	// An incomplete new variant.
+	write("partial/aider.tmpl", "Build {{.Target}}.")
+
+	cfg := defaultConfig()
+	cfg.Prompts.Dir = dir
+	if got := promptVariants(cfg); !slices.Equal(got, []string{"default", "partial", "rules_rust", "terse"}) {
+		t.Errorf("variants = %q", got)
+	}
+	data := promptData{Crate: "grep_cli", Target: "//crates/cli:grep_cli", PackageDir: "crates/cli"}
+	for _, tc := range []struct {
+		variant, name, want string
+	}{
+		{"terse", promptAider, "Build //crates/cli:grep_cli."},
+		{"terse", promptBuildFile, "BUILD.bazel in crates/cli."},
+		{"default", promptAider, "Make //crates/cli:grep_cli build, please."},
+	} {
+		cfg.Prompts.Variant = tc.variant
+		p, err := loadPrompts(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := p.render(tc.name, data); err != nil || got != tc.want {
+			t.Errorf("%s/%s = %q, %v; want %q", tc.variant, tc.name, got, err, tc.want)
+		}
+	}
+	// Templates the override lacks come from the built-in variant.
+	cfg.Prompts.Variant = "default"
+	p, err := loadPrompts(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.render(promptBuildFile, data); err != nil || !strings.Contains(got, "crates/cli") {
+		t.Errorf("default/build_file = %q, %v", got, err)
+	}
+
+	cfg.Prompts.Variant = "partial"
+	if _, err := loadPrompts(cfg); err == nil || !strings.Contains(err.Error(), "has no migrate.tmpl") {
+		t.Errorf("err = %v, want the missing template reported", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Provider types, the values of providers.<name>.type.
+const (
+	providerOpenAI = "openai" // an OpenAI-compatible chat completions API
+	providerOllama = "ollama" // a local Ollama server
+	providerLLM    = "llm"    // the llm CLI, run through the runner
+)
+
+// completionRequest asks a model for a single reply.
+type completionRequest struct {
+	// Model is the name the provider knows the model by.
+	Model string
+	// System is the system prompt and Input the user message.
+	System string
+	Input  []byte
+	// Stream receives the reply as it arrives unless nil.
+	Stream io.Writer
+}
+
+// completion is a model's reply.
+type completion struct {
+	Content string
+	// Usage is nil when the provider does not report it, and for a cached
+	// reply, which costs nothing.
+	Usage *chatUsage
+	// Retries counts the failed requests retried before the reply.
+	Retries int
+}
+
+// llmProvider sends prompts to models of one backend.
+type llmProvider interface {
+	complete(ctx context.Context, req completionRequest) (*completion, error)
+}
+
+// resolveProvider returns the provider serving model, the provider's name in
+// cfg.Providers and the name the provider knows the model by. A model whose
+// first path element names a configured provider, such as
+// "ollama/qwen2.5-coder:7b", is sent to that provider without the prefix; any
+// other model is sent as is to default_provider.
+func resolveProvider(r runner, cfg *config, model string) (p llmProvider, provider, name string, err error) {
+	provider, name = modelProvider(cfg, model)
+	pc, ok := cfg.Providers[provider]
+	if !ok {
+		return nil, "", "", fmt.Errorf("unknown provider %q", provider)
+	}
+	switch pc.Type {
+	case providerOpenAI, "":
+		p = &apiProvider{newOpenAIClient(pc.BaseURL, os.Getenv(pc.APIKeyEnv))}
+	case providerOllama:
+		p = newOllamaClient(pc.BaseURL)
+	case providerLLM:
+		p = &llmCLIProvider{r}
+	default:
+		return nil, "", "", fmt.Errorf("provider %s has unknown type %q", provider, pc.Type)
+	}
+	if l := providerLimiter(cfg, provider); l != nil {
+		p = &limitedProvider{p, l}
+	}
+	return p, provider, name, nil
+}
+
+// modelProvider returns the name of the provider serving model and the name
+// the provider knows the model by; see resolveProvider.
+func modelProvider(cfg *config, model string) (provider, name string) {
+	if prefix, rest, ok := strings.Cut(model, "/"); ok {
+		if _, ok := cfg.Providers[prefix]; ok {
+			return prefix, rest
+		}
+	}
+	return cfg.DefaultProvider, model
+}
+
+// apiProvider serves models through an OpenAI-compatible API.
+type apiProvider struct {
+	client *openAIClient
+}
+
+func (p *apiProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	cr := chatRequest{
+		Model: req.Model,
+		Messages: []chatMessage{
+			{Role: "system", Content: req.System},
+			{Role: "user", Content: string(req.Input)},
+		},
+	}
+	var resp *chatResponse
+	var err error
+	if req.Stream != nil {
+		resp, err = p.client.chatStream(ctx, cr, func(s string) error {
+			_, err := io.WriteString(req.Stream, s)
+			return err
+		})
+	} else {
+		resp, err = p.client.chat(ctx, cr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &completion{Content: resp.content(), Usage: resp.Usage}, nil
+}
+
+// llmCLIProvider serves models through the llm command-line tool.
+type llmCLIProvider struct {
+	r runner
+}
+
+func (p *llmCLIProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	c := newCommand("", "llm", "-m", req.Model, "-s", req.System)
+	c.Stdin = req.Input
+	c.Stdout = req.Stream
+	res, err := p.r.Run(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("'llm' command failed: %w", outputError(err, res))
+	}
+	return &completion{Content: string(res.Stdout)}, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matrixReport is the model × target table of a run's outcomes.
+type matrixReport struct {
+	RunID     string
+	Repo      string
+	Branch    string
+	StartedAt time.Time
+	// Models and Targets are in the order they first appear in the run.
+	Models  []string
+	Targets []string
+	// PromptVariants are the prompt variants the cells were run with.
+	PromptVariants []string
+	// ModelTotals and TargetTotals are indexed like Models and Targets.
+	ModelTotals  []reportTotals
+	TargetTotals []reportTotals
+	Total        reportTotals
+
+	cells map[[2]string]*cellState
+}
+
+// reportTotals sums the outcomes of a row or column of the report.
+type reportTotals struct {
+	Cells       int
+	Succeeded   int
+	Failed      int
+	Attempts    int
+	Retries     int
+	WallSeconds float64
+	Usage       tokenUsage
+}
+
+func (t *reportTotals) add(c *cellState) {
+	t.Cells++
+	switch c.Status {
+	case cellSucceeded:
+		t.Succeeded++
+	case cellFailed, cellPolicyViolation:
+		t.Failed++
+	}
+	t.Attempts += c.Attempts
+	t.Retries += c.Retries
+	t.WallSeconds += c.WallSeconds
+	t.Usage.add(c.Usage)
+}
+
+// newMatrixReport tabulates the cells of s.
+func newMatrixReport(s *runState) *matrixReport {
+	rep := &matrixReport{
+		RunID:     s.RunID,
+		Repo:      s.Repo,
+		Branch:    s.Branch,
+		StartedAt: s.StartedAt,
+		cells:     make(map[[2]string]*cellState),
+	}
+	modelIndex := make(map[string]int)
+	targetIndex := make(map[string]int)
+	for _, c := range s.Cells {
+		mi, ok := modelIndex[c.Model]
+		if !ok {
+			mi = len(rep.Models)
+			modelIndex[c.Model] = mi
+			rep.Models = append(rep.Models, c.Model)
+			rep.ModelTotals = append(rep.ModelTotals, reportTotals{})
+		}
+		ti, ok := targetIndex[c.Target]
+		if !ok {
+			ti = len(rep.Targets)
+			targetIndex[c.Target] = ti
+			rep.Targets = append(rep.Targets, c.Target)
+			rep.TargetTotals = append(rep.TargetTotals, reportTotals{})
+		}
+		if c.PromptVariant != "" && !slices.Contains(rep.PromptVariants, c.PromptVariant) {
+			rep.PromptVariants = append(rep.PromptVariants, c.PromptVariant)
+		}
+		rep.cells[[2]string{c.Model, c.Target}] = c
+		rep.ModelTotals[mi].add(c)
+		rep.TargetTotals[ti].add(c)
+		rep.Total.add(c)
+	}
+	return rep
+}
+
+// cell returns the outcome of model on target, or nil if the run has none.
+func (rep *matrixReport) cell(model, target string) *cellState {
+	return rep.cells[[2]string{model, target}]
+}
+
+// formatWallTime rounds seconds for display.
+func formatWallTime(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+// shortCommit abbreviates a commit hash for display.
+func shortCommit(commit string) string {
+	if len(commit) > 10 {
+		return commit[:10]
+	}
+	return commit
+}
+
+// statusSymbol is the one-character summary of a cell status.
+func statusSymbol(status string) string {
+	switch status {
+	case cellSucceeded:
+		return "✅"
+	case cellFailed:
+		return "❌"
+	case cellError:
+		return "⚠️"
+	case cellInterrupted:
+		return "⏸"
+	case cellRunning:
+		return "▶"
+	case cellOverBudget:
+		return "💸"
+	case cellPolicyViolation:
+		return "🚫"
+	}
+	return "·"
+}
+
+// cellSummary describes c in a single table cell.
+func cellSummary(c *cellState) string {
+	if c == nil {
+		return ""
+	}
+	s := fmt.Sprintf("%s %d att", statusSymbol(c.Status), c.Attempts)
+	if c.Retries > 0 {
+		s += fmt.Sprintf(" (+%d retried)", c.Retries)
+	}
+	s += ", " + formatWallTime(c.WallSeconds)
+	if c.Usage.CostUSD > 0 {
+		s += ", " + formatCost(c.Usage.CostUSD)
+	}
+	if c.Commit != "" {
+		s += ", " + shortCommit(c.Commit)
+	}
+	return s
+}
+
+// totalsSummary describes t in a single table cell.
+func totalsSummary(t reportTotals) string {
+	s := fmt.Sprintf("%d/%d passed, %d att", t.Succeeded, t.Cells, t.Attempts)
+	if t.Retries > 0 {
+		s += fmt.Sprintf(" (+%d retried)", t.Retries)
+	}
+	return s + fmt.Sprintf(", %s, %s", formatWallTime(t.WallSeconds), formatCost(t.Usage.CostUSD))
+}
+
+func formatCost(usd float64) string {
+	return fmt.Sprintf("$%.2f", usd)
+}
+
+// writeMarkdown prints the report as a Markdown table with a row per target
+// and a column per model.
+func (rep *matrixReport) writeMarkdown(w io.Writer) error {
+	pw := &planWriter{w: w}
+	pw.printf("# bld matrix run %s\n\n", rep.RunID)
+	pw.printf("Repository %s, branch %s, started %s.", rep.Repo, rep.Branch, rep.StartedAt.Format(time.RFC3339))
+	if len(rep.PromptVariants) > 0 {
+		pw.printf(" Prompt variant %s.", strings.Join(rep.PromptVariants, ", "))
+	}
+	pw.printf("\n\n| target |")
+	for _, model := range rep.Models {
+		pw.printf(" %s |", markdownEscape(model))
+	}
+	pw.printf(" total |\n|---|")
+	for range rep.Models {
+		pw.printf("---|")
+	}
+	pw.printf("---|\n")
+	for ti, target := range rep.Targets {
+		pw.printf("| %s |", markdownEscape(target))
+		for _, model := range rep.Models {
+			pw.printf(" %s |", cellSummary(rep.cell(model, target)))
+		}
+		pw.printf(" %s |\n", totalsSummary(rep.TargetTotals[ti]))
+	}
+	pw.printf("| **total** |")
+	for mi := range rep.Models {
+		pw.printf(" %s |", totalsSummary(rep.ModelTotals[mi]))
+	}
+	pw.printf(" **%s** |\n", totalsSummary(rep.Total))
+	pw.printf("\n✅ succeeded, ❌ failed, ⚠️ error, ⏸ interrupted, 💸 over budget, 🚫 changed non-Bazel files, ▶ running, · pending; att is attempts used; retried runs of aider that crashed and requests that hit a provider error are not attempts.\n")
+	return pw.err
+}
+
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// writeCSV prints the report with a row per cell, followed by a row per
+// model with target "(total)", a row per target with model "(total)", and a
+// grand total row.
+func (rep *matrixReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"model", "target", "prompt_variant", "status", "attempts", "retries", "wall_seconds", "prompt_tokens", "completion_tokens", "cost_usd", "commit", "error", "succeeded", "cells"})
+	for _, model := range rep.Models {
+		for _, target := range rep.Targets {
+			c := rep.cell(model, target)
+			if c == nil {
+				continue
+			}
+			succeeded := "0"
+			if c.Status == cellSucceeded {
+				succeeded = "1"
+			}
+			cw.Write(slices.Concat(
+				[]string{c.Model, c.Target, c.PromptVariant, c.Status, strconv.Itoa(c.Attempts), strconv.Itoa(c.Retries), formatSeconds(c.WallSeconds)},
+				usageFields(c.Usage),
+				[]string{c.Commit, c.Error, succeeded, "1"},
+			))
+		}
+	}
+	totalRow := func(model, target string, t reportTotals) {
+		cw.Write(slices.Concat(
+			[]string{model, target, "", "", strconv.Itoa(t.Attempts), strconv.Itoa(t.Retries), formatSeconds(t.WallSeconds)},
+			usageFields(t.Usage),
+			[]string{"", "", strconv.Itoa(t.Succeeded), strconv.Itoa(t.Cells)},
+		))
+	}
+	for mi, model := range rep.Models {
+		totalRow(model, "(total)", rep.ModelTotals[mi])
+	}
+	for ti, target := range rep.Targets {
+		totalRow("(total)", target, rep.TargetTotals[ti])
+	}
+	totalRow("(total)", "(total)", rep.Total)
+	cw.Flush()
+	return cw.Error()
+}
+
+func usageFields(u tokenUsage) []string {
+	return []string{strconv.Itoa(u.PromptTokens), strconv.Itoa(u.CompletionTokens), strconv.FormatFloat(u.CostUSD, 'f', 4, 64)}
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 1, 64)
+}
+
+// reportHTML renders a matrixReport as a self-contained page.
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"cell":   func(rep *matrixReport, model, target string) *cellState { return rep.cell(model, target) },
+	"symbol": statusSymbol,
+	"wall":   formatWallTime,
+	"short":  shortCommit,
+	"cost":   formatCost,
+	"totals": totalsSummary,
+	"join":   strings.Join,
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>bld matrix run {{.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+td.succeeded { background: #dff0d8; }
+td.failed, td.policy_violation { background: #f2dede; }
+td.error, td.interrupted, td.over_budget { background: #fcf8e3; }
+td.total, tr.total td { background: #f4f4f4; font-weight: bold; }
+.detail { color: #555; font-size: smaller; }
+</style>
+</head>
+<body>
+<h1>bld matrix run {{.RunID}}</h1>
+<p>Repository {{.Repo}}, branch {{.Branch}}, started {{rfc3339 .StartedAt}}.{{with .PromptVariants}} Prompt variant {{join . ", "}}.{{end}}</p>
+<table>
+<tr><th>target</th>{{range .Models}}<th>{{.}}</th>{{end}}<th>total</th></tr>
+{{- $rep := .}}
+{{- range $ti, $target := .Targets}}
+<tr><th>{{$target}}</th>
+{{- range $.Models}}{{with cell $rep . $target}}
+<td class="{{.Status}}" title="{{.Error}}">{{symbol .Status}} {{.Status}}<div class="detail">{{.Attempts}} att{{if .Retries}} (+{{.Retries}} retried){{end}}, {{wall .WallSeconds}}{{if .Usage.CostUSD}}, {{cost .Usage.CostUSD}}{{end}}{{if .Commit}}, <code>{{short .Commit}}</code>{{end}}</div></td>
+{{- else}}
+<td></td>
+{{- end}}{{end}}
+<td class="total">{{totals (index $.TargetTotals $ti)}}</td></tr>
+{{- end}}
+<tr class="total"><td>total</td>{{range .ModelTotals}}<td>{{totals .}}</td>{{end}}<td>{{totals .Total}}</td></tr>
+</table>
+<p class="detail">att is attempts used; retried runs of aider that crashed and requests that hit a provider error are not attempts; hover over a cell for its error.</p>
+</body>
+</html>
+`))
+
+// writeHTML prints the report as a self-contained HTML page.
+func (rep *matrixReport) writeHTML(w io.Writer) error {
+	return reportHTML.Execute(w, rep)
+}
+
+// reportFormats are the formats of "bld report", by name.
+var reportFormats = map[string]func(rep *matrixReport, w io.Writer) error{
+	"md":   (*matrixReport).writeMarkdown,
+	"csv":  (*matrixReport).writeCSV,
+	"html": (*matrixReport).writeHTML,
+}
+
+// runReport implements "bld report": it prints the results matrix of the last
+// run of the current branch, or of the given state file.
+func runReport(ctx context.Context, args []string) error {
+	fs := newFlagSet("report")
+	common := registerCommonFlags(fs)
+	format := fs.String("format", "md", "report format: md, csv or html")
+	out := fs.String("o", "", "write the report to this file instead of stdout")
+	statePath := fs.String("state", "", "read this state file instead of the last run's of the current branch")
+	fs.Parse(args)
+	write, ok := reportFormats[*format]
+	if !ok {
+		return fmt.Errorf("-format: unknown format %q; want md, csv or html", *format)
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+
+	path := *statePath
+	if path == "" {
+		branch, err := getGitBranch(ctx, newRunner(cfg), cfg.Repo)
+		if err != nil {
+			return fmt.Errorf("error getting git branch: %w", err)
+		}
+		worktreeBaseDir, err := cfg.worktreeBaseDir()
+		if err != nil {
+			return err
+		}
+		path = runStatePath(worktreeBaseDir, branch)
+	}
+	s, err := readRunState(path)
+	if err != nil {
+		return err
+	}
+	rep := newMatrixReport(s)
+
+	if *out == "" {
+		return write(rep, os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("error creating report: %w", err)
+	}
+	if err := write(rep, f); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing report %s: %w", *out, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing report %s: %w", *out, err)
+	}
+	log.Printf("Wrote %s report to %s", *format, *out)
+	return nil
+}
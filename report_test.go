@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testReport is a run of two models, one with characters that need escaping
+// in every format, on two targets.
+func testReport() *matrixReport {
+	s := &runState{
+		RunID:     "20250908T120000Z",
+		Repo:      "/src/ripgrep",
+		Branch:    "main",
+		StartedAt: time.Date(2025, 9, 8, 12, 0, 0, 0, time.UTC),
+		Cells: []*cellState{
+			{
+				Model: "openrouter/x-ai/grok-code-fast-1", Target: "//crates/cli:grep_cli", Status: cellSucceeded,
+				Attempts: 2, Retries: 1, PromptVariant: "rules_rust", WallSeconds: 95.4,
+				Usage:  tokenUsage{PromptTokens: 12000, CompletionTokens: 800, CostUSD: 0.0123},
+				Commit: "0123456789abcdef0123456789abcdef01234567",
+			},
+			{
+				Model: "openrouter/x-ai/grok-code-fast-1", Target: "//crates/core:rg", Status: cellFailed,
+				Attempts: 5, PromptVariant: "rules_rust", WallSeconds: 600,
+				Usage: tokenUsage{PromptTokens: 50000, CompletionTokens: 3000, CostUSD: 0.05},
+			},
+			{
+				Model: "ollama/<b>|evil", Target: "//crates/cli:grep_cli", Status: cellError,
+				Attempts: 1, PromptVariant: "rules_rust", WallSeconds: 3,
+				Error: `aider failed: "quoted" <script>alert(1)</script>, & more`,
+			},
+		},
+	}
+	return newMatrixReport(s)
+}
+
+func TestReportFormats(t *testing.T) {
+	for name, write := range reportFormats {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := write(testReport(), &buf); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "report."+name)
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestReportHTMLEscapes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().writeHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, raw := range []string{"<b>", "<script>"} {
+		if strings.Contains(html, raw) {
+			t.Errorf("%s is not escaped", raw)
+		}
+	}
+	for _, escaped := range []string{
+		"<th>ollama/&lt;b&gt;|evil</th>",
+		`title="aider failed: &#34;quoted&#34; &lt;script&gt;alert(1)&lt;/script&gt;, &amp; more"`,
+	} {
+		if !strings.Contains(html, escaped) {
+			t.Errorf("page does not contain %s", escaped)
+		}
+	}
+}
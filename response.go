@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// errNoUsableContent is returned when an LLM reply holds no Bazel file.
+var errNoUsableContent = errors.New("no usable Bazel content in LLM reply")
+
+// bazelFile is a file extracted from an LLM reply. Path is slash-separated
+// and relative to the workspace root.
+type bazelFile struct {
+	Path    string
+	Content string
+}
+
+// isBazelFileName reports whether a model may write a file with this base
+// name.
+func isBazelFileName(name string) bool {
+	switch name {
+	case "BUILD", "BUILD.bazel", "MODULE.bazel", "WORKSPACE", "WORKSPACE.bazel":
+		return true
+	}
+	return strings.HasSuffix(name, ".bzl")
+}
+
+// starlarkLangs are the info strings of fenced blocks that may hold Starlark.
+var starlarkLangs = map[string]bool{
+	"": true, "starlark": true, "skylark": true, "bazel": true, "bzl": true,
+	"python": true, "py": true, "build": true, "text": true,
+}
+
+var (
+	// fileNameRE finds a Bazel file name in a heading, caption or comment,
+	// such as "**crates/cli/BUILD.bazel**", "--- MODULE.bazel ---" or
+	// "# BUILD.bazel".
+	fileNameRE = regexp.MustCompile(`\b((?:[\w.+-]+/)*(?:BUILD\.bazel|BUILD|MODULE\.bazel|WORKSPACE\.bazel|WORKSPACE|[\w.+-]+\.bzl))\b`)
+	// starlarkStmtRE matches the start of a Starlark statement: a call,
+	// an assignment or a comment.
+	starlarkStmtRE = regexp.MustCompile(`^(?:#|[A-Za-z_][\w.]*\s*(?:\(|=))`)
+	// starlarkCallRE matches a call, which every useful Bazel file has.
+	starlarkCallRE = regexp.MustCompile(`(?m)^\s*[A-Za-z_][\w.]*\s*\(`)
+	// moduleCallRE matches calls only valid in MODULE.bazel.
+	moduleCallRE = regexp.MustCompile(`(?m)^\s*(?:module|bazel_dep|use_extension|use_repo|register_toolchains|archive_override|git_override|local_path_override|single_version_override)\s*\(`)
+)
+
+// parseBazelFiles extracts the Bazel files of an LLM reply. Fenced code
+// blocks are used if there are any, and the reply as a whole, without
+// leading and trailing prose, otherwise. A block is named by a file name in
+// its info string, its first comment line or the line before it; an unnamed
+// block goes to MODULE.bazel if it only makes sense there and to
+// defaultPath otherwise. Blocks with the same path are concatenated. Files
+// not named like Bazel files are dropped. It returns errNoUsableContent if
+// nothing remains.
+func parseBazelFiles(reply, defaultPath string) ([]bazelFile, error) {
+	blocks := fencedBlocks(reply)
+	if len(blocks) == 0 {
+		blocks = unfencedBlocks(reply)
+	}
+	var files []bazelFile
+	index := make(map[string]int)
+	for _, b := range blocks {
+		content := strings.TrimSpace(b.content)
+		if !starlarkCallRE.MatchString(content) {
+			continue
+		}
+		p := b.name
+		if p == "MODULE.bazel" && !moduleCallRE.MatchString(content) {
+			// Misnamed, e.g. by a caption mentioning MODULE.bazel.
+			p = ""
+		}
+		switch {
+		case p == "" && moduleCallRE.MatchString(content):
+			p = "MODULE.bazel"
+		case p == "":
+			p = defaultPath
+		case !strings.Contains(p, "/") && p != "MODULE.bazel" && !strings.HasPrefix(p, "WORKSPACE"):
+			// A bare BUILD.bazel or .bzl file belongs next to defaultPath.
+			p = path.Join(path.Dir(defaultPath), p)
+		}
+		p = path.Clean(strings.TrimPrefix(p, "./"))
+		if !isBazelFileName(path.Base(p)) || strings.HasPrefix(p, "../") || path.IsAbs(p) {
+			continue
+		}
+		if i, ok := index[p]; ok {
+			files[i].Content += "\n" + content + "\n"
+			continue
+		}
+		index[p] = len(files)
+		files = append(files, bazelFile{Path: p, Content: content + "\n"})
+	}
+	if len(files) == 0 {
+		return nil, errNoUsableContent
+	}
+	return files, nil
+}
+
+// writeBazelFiles writes files under dir and returns their paths.
+func writeBazelFiles(dir string, files []bazelFile) ([]string, error) {
+	var paths []string
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, fmt.Errorf("error creating dir for %s: %w", p, err)
+		}
+		if err := os.WriteFile(p, []byte(f.Content), 0644); err != nil {
+			return nil, fmt.Errorf("error writing %s: %w", p, err)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// replyBlock is a candidate file of a reply, named if the reply says which
+// file it is.
+type replyBlock struct {
+	name    string
+	content string
+}
+
+// fencedBlocks returns the Starlark fenced code blocks of reply. An
+// unterminated block runs to the end of the reply.
+func fencedBlocks(reply string) []replyBlock {
+	var blocks []replyBlock
+	lines := strings.Split(reply, "\n")
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+			continue
+		}
+		fence := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+		info := strings.TrimSpace(trimmed[len(fence):])
+		end := len(lines)
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j]) == fence {
+				end = j
+				break
+			}
+		}
+		body := lines[i+1 : end]
+		lang, _, _ := strings.Cut(info, " ")
+		name := fileName(info)
+		if name != "" || starlarkLangs[strings.ToLower(lang)] {
+			if name == "" && len(body) > 0 && strings.HasPrefix(strings.TrimSpace(body[0]), "#") {
+				name = fileName(body[0])
+			}
+			if name == "" {
+				// Prose such as "Add this to the BUILD.bazel next to
+				// MODULE.bazel" is ambiguous; the last name is likelier
+				// to be the one introducing the block.
+				names := fileNameRE.FindAllString(previousLine(lines, i), -1)
+				if len(names) > 0 {
+					name = names[len(names)-1]
+				}
+			}
+			blocks = append(blocks, replyBlock{name: name, content: strings.Join(body, "\n")})
+		}
+		i = end
+	}
+	return blocks
+}
+
+// unfencedBlocks splits a reply without fences into files at lines that
+// only name a file, such as "--- MODULE.bazel ---" or "BUILD.bazel:", and
+// drops the prose before and after the Starlark of each file.
+func unfencedBlocks(reply string) []replyBlock {
+	var blocks []replyBlock
+	cur := replyBlock{}
+	var body []string
+	flush := func() {
+		if content := trimProse(body); content != "" {
+			cur.content = content
+			blocks = append(blocks, cur)
+		}
+		body = nil
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		if name := fileMarker(line); name != "" {
+			flush()
+			cur = replyBlock{name: name}
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	return blocks
+}
+
+// trimProse returns lines from the first Starlark statement to the last line
+// that could end one.
+func trimProse(lines []string) string {
+	start, end := -1, -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if start < 0 {
+			if starlarkStmtRE.MatchString(trimmed) {
+				start = i
+			} else {
+				continue
+			}
+		}
+		if trimmed == "" {
+			continue
+		}
+		// Statements end with a closing bracket or a value; prose ends
+		// with punctuation or a word.
+		if starlarkStmtRE.MatchString(trimmed) || strings.ContainsAny(trimmed[len(trimmed)-1:], ")]},\"'0123456789") || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			end = i
+		} else {
+			break
+		}
+	}
+	if start < 0 || end < start {
+		return ""
+	}
+	return strings.Join(lines[start:end+1], "\n")
+}
+
+// fileName returns the Bazel file named in s, or "" if there is none.
+func fileName(s string) string {
+	return fileNameRE.FindString(s)
+}
+
+// fileMarker returns the file named by a line holding nothing but a file
+// name and decoration, such as "--- MODULE.bazel ---" or "**BUILD.bazel**:".
+func fileMarker(line string) string {
+	s := strings.Trim(strings.TrimSpace(line), "*-=#`:~_ ")
+	s = strings.TrimSpace(strings.TrimPrefix(s, "File"))
+	s = strings.Trim(s, ":` ")
+	if name := fileName(s); name != "" && name == s {
+		return name
+	}
+	return ""
+}
+
+// previousLine returns the last non-blank line before lines[i].
+func previousLine(lines []string, i int) string {
+	for j := i - 1; j >= 0; j-- {
+		if strings.TrimSpace(lines[j]) != "" {
+			return lines[j]
+		}
+	}
+	return ""
+}
+
+// describeFiles lists the paths of files for messages.
+func describeFiles(files []bazelFile) string {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	return fmt.Sprintf("%d file(s): %s", len(files), strings.Join(paths, ", "))
+}
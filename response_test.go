@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseBazelFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		reply   string
+		want    []bazelFile
+		wantErr error
+	}{
+		{
+			name: "several fenced files",
+			reply: "Add the dependency:\n\n```starlark MODULE.bazel\nbazel_dep(name = \"rules_rust\", version = \"0.64.0\")\n```\n\n" +
+				"**crates/a/BUILD.bazel**\n```python\nrust_library(name = \"a\")\n```\n\n" +
+				"```starlark\n# crates/a/defs.bzl\ndef a():\n    native.alias(name = \"x\", actual = \":a\")\n```\n",
+			want: []bazelFile{
+				{Path: "MODULE.bazel", Content: "bazel_dep(name = \"rules_rust\", version = \"0.64.0\")\n"},
+				{Path: "crates/a/BUILD.bazel", Content: "rust_library(name = \"a\")\n"},
+				{Path: "crates/a/defs.bzl", Content: "# crates/a/defs.bzl\ndef a():\n    native.alias(name = \"x\", actual = \":a\")\n"},
+			},
+		},
+		{
+			name:  "missing path header",
+			reply: "Here it is:\n\n```starlark\nrust_binary(name = \"cli\")\n```\n",
+			want:  []bazelFile{{Path: "crates/cli/BUILD.bazel", Content: "rust_binary(name = \"cli\")\n"}},
+		},
+		{
+			name:  "missing path header of a MODULE.bazel",
+			reply: "```\nmodule(name = \"m\")\n```\n",
+			want:  []bazelFile{{Path: "MODULE.bazel", Content: "module(name = \"m\")\n"}},
+		},
+		{
+			name:  "bare file name",
+			reply: "BUILD.bazel:\n```\nrust_binary(name = \"cli\")\n```\n",
+			want:  []bazelFile{{Path: "crates/cli/BUILD.bazel", Content: "rust_binary(name = \"cli\")\n"}},
+		},
+		{
+			name: "path outside the workspace",
+			reply: "```starlark crates/../../BUILD.bazel\nrust_library(name = \"evil\")\n```\n\n" +
+				"```starlark crates/cli/BUILD.bazel\nrust_binary(name = \"cli\")\n```\n",
+			want: []bazelFile{{Path: "crates/cli/BUILD.bazel", Content: "rust_binary(name = \"cli\")\n"}},
+		},
+		{
+			name:    "only a path outside the workspace",
+			reply:   "```starlark crates/../../BUILD.bazel\nrust_library(name = \"evil\")\n```\n",
+			wantErr: errNoUsableContent,
+		},
+		{
+			name:  "unfenced files",
+			reply: "Sure.\n\n--- MODULE.bazel ---\nmodule(name = \"m\")\n\n--- crates/cli/BUILD.bazel ---\nrust_binary(name = \"cli\")\n\nThis should build.\n",
+			want: []bazelFile{
+				{Path: "MODULE.bazel", Content: "module(name = \"m\")\n"},
+				{Path: "crates/cli/BUILD.bazel", Content: "rust_binary(name = \"cli\")\n"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseBazelFiles(tc.reply, "crates/cli/BUILD.bazel")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
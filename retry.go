@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// retry calls f until it succeeds or fails with an error transient rejects,
+// retrying at most rc.MaxRetries times. Before each retry it waits with
+// exponential backoff and jitter, or as long as an apiError asks. It returns
+// the number of retries made and f's last error, or the context's error if
+// ctx is done while waiting.
+func retry(ctx context.Context, rc retryConfig, what string, transient func(error) bool, f func() error) (int, error) {
+	for n := 0; ; n++ {
+		err := f()
+		if err == nil || n >= rc.MaxRetries || ctx.Err() != nil || !transient(err) {
+			return n, err
+		}
+		d := backoff(rc, n, err)
+		loggerFrom(ctx).Printf("%s failed: %v; retrying in %s (retry %d/%d)", what, err, d.Round(time.Millisecond), n+1, rc.MaxRetries)
+		if err := sleep(ctx, d); err != nil {
+			return n, err
+		}
+	}
+}
+
+// backoff returns the wait before retry n+1: a random duration between half
+// of and the whole of InitialDelay·2ⁿ, capped at MaxDelay, unless err asks
+// for a longer wait, which is honored up to MaxDelay.
+func backoff(rc retryConfig, n int, err error) time.Duration {
+	ceiling := rc.MaxDelay
+	if n < 32 && rc.InitialDelay<<n < ceiling {
+		ceiling = rc.InitialDelay << n
+	}
+	d := ceiling/2 + jitter(ceiling/2+1)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > d {
+		d = min(apiErr.RetryAfter, rc.MaxDelay)
+	}
+	return d
+}
+
+// jitter returns a random duration in [0, n). Tests replace it.
+var jitter = rand.N[time.Duration]
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// isTransientLLMError reports whether a request to a provider failed in a
+// way that may not recur: it was rate limited, the server failed or
+// timed out, the connection could not be made or the reply was cut short.
+// Errors in the request, such as a bad model name or API key, and requests
+// that hit bld's own timeout are not retried.
+func isTransientLLMError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusRequestTimeout, apiErr.StatusCode == http.StatusTooManyRequests, apiErr.StatusCode >= 500:
+			return true
+		case apiErr.StatusCode == 0:
+			// An error inside a streamed reply.
+			return transientAPIErrorRE.MatchString(apiErr.Type + " " + apiErr.Code + " " + apiErr.Message)
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+var (
+	// transientAPIErrorRE matches the errors a provider reports inside a
+	// streamed reply that are worth retrying.
+	transientAPIErrorRE = regexp.MustCompile(`(?i)rate.?limit|overloaded|server.?error|unavailable|timeout|\b(408|429|5\d\d)\b`)
+	// aiderPermanentRE matches aider output about failures retrying will
+	// not fix, as reported by litellm.
+	aiderPermanentRE = regexp.MustCompile(`AuthenticationError|NotFoundError|BadRequestError|PermissionDeniedError|ContextWindowExceededError|Unknown model`)
+)
+
+// isTransientAiderFailure reports whether a failed aider run is worth
+// retrying. Aider exits with an error both when it crashes and when the
+// provider fails it, so failures are retried unless aider timed out or its
+// output shows a failure that will recur.
+func isTransientAiderFailure(err error, res *result) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return res == nil || !aiderPermanentRE.Match(res.Combined)
+}
+
+// rateLimiter spaces out events by at least interval.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the next event may happen.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if d := l.reserve(time.Now()); d > 0 {
+		loggerFrom(ctx).Printf("Rate limited; waiting %s", d.Round(time.Millisecond))
+		return sleep(ctx, d)
+	}
+	return nil
+}
+
+// reserve books the next event and returns how long after now it may
+// happen.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	return at.Sub(now)
+}
+
+// providerLimiters holds the rate limiter of each provider with a
+// requests_per_minute, shared by every request in the process.
+var providerLimiters = struct {
+	sync.Mutex
+	m map[string]*rateLimiter
+}{m: make(map[string]*rateLimiter)}
+
+// providerLimiter returns the rate limiter of the provider named provider,
+// or nil if the provider has no limit.
+func providerLimiter(cfg *config, provider string) *rateLimiter {
+	rpm := cfg.Providers[provider].RequestsPerMinute
+	if rpm <= 0 {
+		return nil
+	}
+	providerLimiters.Lock()
+	defer providerLimiters.Unlock()
+	l, ok := providerLimiters.m[provider]
+	if !ok {
+		l = &rateLimiter{interval: time.Duration(float64(time.Minute) / rpm)}
+		providerLimiters.m[provider] = l
+	}
+	return l
+}
+
+// limitedProvider waits for its rate limiter before each request.
+type limitedProvider struct {
+	llmProvider
+	limiter *rateLimiter
+}
+
+func (p *limitedProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	if err := p.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return p.llmProvider.complete(ctx, req)
+}
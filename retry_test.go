@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// withJitter makes backoff draw j(n) instead of a random duration below n
+// for the rest of the test.
+func withJitter(t *testing.T, j func(n time.Duration) time.Duration) {
+	t.Helper()
+	saved := jitter
+	jitter = j
+	t.Cleanup(func() { jitter = saved })
+}
+
+func TestBackoff(t *testing.T) {
+	rc := retryConfig{MaxRetries: 10, InitialDelay: 2 * time.Second, MaxDelay: time.Minute}
+	for _, tc := range []struct {
+		n        int
+		err      error
+		min, max time.Duration
+	}{
+		{n: 0, min: time.Second, max: 2 * time.Second},
+		{n: 1, min: 2 * time.Second, max: 4 * time.Second},
+		{n: 4, min: 16 * time.Second, max: 32 * time.Second},
+		// Capped at MaxDelay, however many retries.
+		{n: 5, min: 30 * time.Second, max: time.Minute},
+		{n: 40, min: 30 * time.Second, max: time.Minute},
+		// A Retry-After longer than the backoff is honored up to MaxDelay.
+		{n: 0, err: &apiError{StatusCode: 429, RetryAfter: 10 * time.Second}, min: 10 * time.Second, max: 10 * time.Second},
+		{n: 0, err: &apiError{StatusCode: 429, RetryAfter: time.Hour}, min: time.Minute, max: time.Minute},
+		// A shorter one is not.
+		{n: 4, err: &apiError{StatusCode: 429, RetryAfter: time.Second}, min: 16 * time.Second, max: 32 * time.Second},
+	} {
+		t.Run(fmt.Sprintf("retry %d after %v", tc.n+1, tc.err), func(t *testing.T) {
+			withJitter(t, func(time.Duration) time.Duration { return 0 })
+			if d := backoff(rc, tc.n, tc.err); d != tc.min {
+				t.Errorf("least backoff = %s, want %s", d, tc.min)
+			}
+			withJitter(t, func(n time.Duration) time.Duration { return n - 1 })
+			if d := backoff(rc, tc.n, tc.err); d != tc.max {
+				t.Errorf("greatest backoff = %s, want %s", d, tc.max)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	withJitter(t, func(time.Duration) time.Duration { return 0 })
+	rc := retryConfig{MaxRetries: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	transient := errors.New("transient")
+	isTransient := func(err error) bool { return errors.Is(err, transient) }
+	for _, tc := range []struct {
+		name        string
+		errs        []error
+		wantCalls   int
+		wantRetries int
+		wantErr     error
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "retried", errs: []error{transient, transient, nil}, wantCalls: 3, wantRetries: 2},
+		{name: "permanent", errs: []error{transient, io.EOF}, wantCalls: 2, wantRetries: 1, wantErr: io.EOF},
+		{name: "retries run out", errs: []error{transient, transient, transient, transient, nil}, wantCalls: 4, wantRetries: 3, wantErr: transient},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			retries, err := retry(context.Background(), rc, "test", isTransient, func() error {
+				calls++
+				return tc.errs[calls-1]
+			})
+			if calls != tc.wantCalls || retries != tc.wantRetries || !errors.Is(err, tc.wantErr) {
+				t.Errorf("got %d calls, %d retries, %v; want %d, %d, %v", calls, retries, err, tc.wantCalls, tc.wantRetries, tc.wantErr)
+			}
+		})
+	}
+
+	// Cancelling stops the wait for a retry.
+	ctx, cancel := context.WithCancel(context.Background())
+	rc = retryConfig{MaxRetries: 3, InitialDelay: time.Hour, MaxDelay: time.Hour}
+	calls := 0
+	_, err := retry(ctx, rc, "test", isTransient, func() error {
+		calls++
+		time.AfterFunc(time.Millisecond, cancel)
+		return transient
+	})
+	if calls != 1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %d calls, %v; want 1 call and context.Canceled", calls, err)
+	}
+
+	// A call failing because ctx is done is not retried.
+	ctx, cancel = context.WithCancel(context.Background())
+	calls = 0
+	_, err = retry(ctx, rc, "test", isTransient, func() error {
+		calls++
+		cancel()
+		return transient
+	})
+	if calls != 1 || !errors.Is(err, transient) {
+		t.Errorf("got %d calls, %v; want 1 call and its error", calls, err)
+	}
+}
+
+func TestIsTransientLLMError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{err: &apiError{StatusCode: 429}, want: true},
+		{err: &apiError{StatusCode: 408}, want: true},
+		{err: &apiError{StatusCode: 500}, want: true},
+		{err: &apiError{StatusCode: 503}, want: true},
+		{err: &apiError{StatusCode: 400, Message: "rate limit"}},
+		{err: &apiError{StatusCode: 401}},
+		{err: &apiError{StatusCode: 404}},
+		{err: &apiError{Code: "429", Message: "Rate limit exceeded"}, want: true},
+		{err: &apiError{Message: "Provider overloaded"}, want: true},
+		{err: &apiError{Type: "server_error"}, want: true},
+		{err: &apiError{Message: "context length exceeded"}},
+		{err: fmt.Errorf("error reading chat stream: %w", io.ErrUnexpectedEOF), want: true},
+		{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{err: fmt.Errorf("request: %w", context.DeadlineExceeded)},
+		{err: context.Canceled},
+		{err: errors.New("bad request")},
+	} {
+		if got := isTransientLLMError(tc.err); got != tc.want {
+			t.Errorf("isTransientLLMError(%#v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestIsTransientAiderFailure(t *testing.T) {
+	exit := errors.New("exit status 1")
+	for _, tc := range []struct {
+		name string
+		err  error
+		res  *result
+		want bool
+	}{
+		{name: "crash", err: exit, res: &result{Combined: []byte("Traceback (most recent call last):")}, want: true},
+		{name: "rate limited", err: exit, res: &result{Combined: []byte("litellm.RateLimitError: slow down")}, want: true},
+		{name: "not started", err: exit, want: true},
+		{name: "bad key", err: exit, res: &result{Combined: []byte("litellm.AuthenticationError: invalid key")}},
+		{name: "unknown model", err: exit, res: &result{Combined: []byte("Unknown model openrouter/x")}},
+		{name: "timed out", err: fmt.Errorf("%w (%w)", exit, context.DeadlineExceeded), res: &result{}},
+		{name: "interrupted", err: fmt.Errorf("%w (%w)", exit, context.Canceled), res: &result{}},
+	} {
+		if got := isTransientAiderFailure(tc.err, tc.res); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{interval: 10 * time.Second}
+	t0 := time.Date(2025, 9, 8, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		at   time.Duration // after t0
+		want time.Duration
+	}{
+		{at: 0, want: 0},
+		// Events in a burst are spaced out by the interval.
+		{at: 0, want: 10 * time.Second},
+		{at: time.Second, want: 19 * time.Second},
+		// After a pause, the next event may happen at once.
+		{at: time.Minute, want: 0},
+		{at: time.Minute + 4*time.Second, want: 6 * time.Second},
+	} {
+		if got := l.reserve(t0.Add(tc.at)); got != tc.want {
+			t.Errorf("event at %s waits %s, want %s", tc.at, got, tc.want)
+		}
+	}
+
+	// Providers share a limiter; those without requests_per_minute have none.
+	cfg := defaultConfig()
+	cfg.Providers["limited"] = providerConfig{Type: providerOpenAI, RequestsPerMinute: 30}
+	if l := providerLimiter(cfg, "limited"); l == nil || l.interval != 2*time.Second || providerLimiter(cfg, "limited") != l {
+		t.Errorf("limiter of a provider with 30 requests a minute = %+v", l)
+	}
+	if l := providerLimiter(cfg, "openrouter"); l != nil {
+		t.Errorf("limiter of a provider without a limit = %+v", l)
+	}
+}
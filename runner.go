@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command describes a subprocess for a runner to execute.
+type command struct {
+	Name string
+	Args []string
+	// Dir is the working directory; empty means the current directory.
+	Dir string
+	// Env holds KEY=value pairs added to the environment of bld itself.
+	Env []string
+	// Stdin is fed to the process when non-nil.
+	Stdin []byte
+	// Timeout bounds the run when positive.
+	Timeout time.Duration
+	// Stdout and Stderr, when non-nil, receive the output as it is
+	// produced in addition to it being captured in the result.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newCommand returns a command running name with args in dir.
+func newCommand(dir, name string, args ...string) *command {
+	return &command{Name: name, Args: args, Dir: dir}
+}
+
+// String returns the command line, quoting arguments that contain spaces.
+func (c *command) String() string {
+	parts := make([]string, 0, len(c.Args)+1)
+	parts = append(parts, c.Name)
+	for _, a := range c.Args {
+		if a == "" || strings.ContainsAny(a, " \t\n\"'") {
+			a = fmt.Sprintf("%q", a)
+		}
+		parts = append(parts, a)
+	}
+	return strings.Join(parts, " ")
+}
+
+// result is the outcome of a command.
+type result struct {
+	Stdout []byte
+	Stderr []byte
+	// Combined interleaves stdout and stderr in the order they were written.
+	Combined []byte
+	// ExitCode is the process exit code, or -1 if it did not exit normally.
+	ExitCode int
+	Duration time.Duration
+}
+
+// runner executes commands. Every git, bazel, cargo, aider and llm call goes
+// through a runner so that it can be logged, recorded, or replaced.
+//
+// Run returns a non-nil result whenever the process was started, even if it
+// failed, so that callers can inspect its output and exit code.
+type runner interface {
+	Run(ctx context.Context, c *command) (*result, error)
+}
+
+// execRunner runs commands as local subprocesses.
+type execRunner struct{}
+
+// killGrace is how long a cancelled command may take to exit after SIGTERM.
+const killGrace = 10 * time.Second
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (execRunner) Run(ctx context.Context, c *command) (*result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	setProcessGroup(cmd, killGrace)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	var combined lockedBuffer
+	outs := []io.Writer{&stdout, &combined}
+	if c.Stdout != nil {
+		outs = append(outs, c.Stdout)
+	}
+	errs := []io.Writer{&stderr, &combined}
+	if c.Stderr != nil {
+		errs = append(errs, c.Stderr)
+	}
+	cmd.Stdout = io.MultiWriter(outs...)
+	cmd.Stderr = io.MultiWriter(errs...)
+
+	start := time.Now()
+	err := cmd.Run()
+	if cmd.ProcessState == nil {
+		return nil, err
+	}
+	res := &result{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		Combined: combined.buf.Bytes(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Duration: time.Since(start),
+	}
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w (%w)", err, ctx.Err())
+	}
+	return res, err
+}
+
+// loggingRunner logs every command before and after it runs to the logger
+// of the command's context.
+type loggingRunner struct {
+	next runner
+}
+
+// newLoggingRunner returns a runner logging the commands of next.
+func newLoggingRunner(next runner) *loggingRunner {
+	return &loggingRunner{next: next}
+}
+
+func (r *loggingRunner) Run(ctx context.Context, c *command) (*result, error) {
+	logger := loggerFrom(ctx)
+	if c.Dir != "" {
+		logger.Printf("running command in %s: %s", c.Dir, c)
+	} else {
+		logger.Printf("running command: %s", c)
+	}
+	res, err := r.next.Run(ctx, c)
+	if err != nil {
+		logger.Printf("command %s failed: %v", c.Name, err)
+		return res, err
+	}
+	logger.Printf("command %s completed successfully in %s.", c.Name, res.Duration.Round(time.Millisecond))
+	return res, nil
+}
+
+// timeoutRunner bounds commands that have no timeout of their own by the
+// timeout configured for their program, if any.
+type timeoutRunner struct {
+	next     runner
+	timeouts map[string]time.Duration
+}
+
+func (r *timeoutRunner) Run(ctx context.Context, c *command) (*result, error) {
+	if t := r.timeouts[c.Name]; c.Timeout == 0 && t > 0 {
+		cc := *c
+		cc.Timeout = t
+		c = &cc
+	}
+	return r.next.Run(ctx, c)
+}
+
+// newRunner returns the runner used by bld's commands: it runs subprocesses
+// with the timeouts of cfg and logs them.
+func newRunner(cfg *config) runner {
+	return newLoggingRunner(&timeoutRunner{next: execRunner{}, timeouts: cfg.Timeouts})
+}
+
+// recordingRunner records commands instead of running them. Respond, when
+// set, supplies each command's result; otherwise every command succeeds with
+// no output.
+type recordingRunner struct {
+	mu       sync.Mutex
+	Commands []*command
+	Respond  func(c *command) (*result, error)
+}
+
+func (r *recordingRunner) Run(ctx context.Context, c *command) (*result, error) {
+	r.mu.Lock()
+	r.Commands = append(r.Commands, c)
+	r.mu.Unlock()
+	if r.Respond != nil {
+		return r.Respond(c)
+	}
+	return &result{}, nil
+}
+
+// outputError returns err annotated with the stderr captured in res, if any.
+func outputError(err error, res *result) error {
+	if res == nil || len(bytes.TrimSpace(res.Stderr)) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w\n%s", err, bytes.TrimSpace(res.Stderr))
+}
+
+// outputTail returns out without surrounding space, cut to its last max
+// bytes, which is where tools such as bazel report their errors.
+func outputTail(out []byte, max int) string {
+	out = bytes.TrimSpace(out)
+	if len(out) > max {
+		return "(output truncated) ...\n" + string(out[len(out)-max:])
+	}
+	return string(out)
+}
+
+// combinedOutput returns the combined output of res, which may be nil.
+func combinedOutput(res *result) []byte {
+	if res == nil {
+		return nil
+	}
+	return res.Combined
+}
@@ -0,0 +1,13 @@
+package main
+
+import "errors"
+
+// exitError returns the result and error of a command that exited with code.
+func exitError(code int) (*result, error) {
+	return &result{ExitCode: code}, errors.New("exit status")
+}
+
+// argv returns the command line of c as planCommand records it.
+func argv(c *command) []string {
+	return append([]string{c.Name}, c.Args...)
+}
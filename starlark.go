@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// formatBazelFile parses content as the Bazel file at path, choosing the
+// BUILD, MODULE.bazel or .bzl dialect by its name, and returns it formatted
+// as buildifier would. The error of a file that does not parse names the
+// line and column at fault.
+func formatBazelFile(path string, content []byte) ([]byte, error) {
+	f, err := build.Parse(path, content)
+	if err != nil {
+		return nil, err
+	}
+	return build.Format(f), nil
+}
+
+// formatBazelFiles formats each of files in place. It reports every file that
+// does not parse.
+func formatBazelFiles(files []bazelFile) error {
+	var errs []error
+	for i, f := range files {
+		formatted, err := formatBazelFile(f.Path, []byte(f.Content))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		files[i].Content = string(formatted)
+	}
+	return errors.Join(errs...)
+}
+
+// formatChangedBazelFiles formats the Bazel files changed or added in the
+// worktree at dir since rev, whether the change is committed or not, so
+// that the edits aider committed are checked too. It returns the parse
+// errors of the files that do not parse, which leaves them unchanged, as a
+// message for the model; the error is for failures to read or write the
+// files.
+func formatChangedBazelFiles(ctx context.Context, r runner, dir, rev string) (string, error) {
+	changed, err := gitChangedSince(ctx, r, dir, rev)
+	if err != nil {
+		return "", err
+	}
+	var problems []string
+	for _, rel := range changed {
+		if !isBazelFileName(filepath.Base(rel)) {
+			continue
+		}
+		p := filepath.Join(dir, rel)
+		content, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // deleted
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %w", p, err)
+		}
+		formatted, err := formatBazelFile(rel, content)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if bytes.Equal(formatted, content) {
+			continue
+		}
+		if err := os.WriteFile(p, formatted, 0644); err != nil {
+			return "", fmt.Errorf("error writing %s: %w", p, err)
+		}
+		loggerFrom(ctx).Printf("Formatted %s", p)
+	}
+	return strings.Join(problems, "\n"), nil
+}
+
+// crateUniverseRepos returns the repositories MODULE.bazel creates with the
+// crate_universe extension, such as "crates" for
+//
+//	crate = use_extension("@rules_rust//crate_universe:extensions.bzl", "crate")
+//	crate.from_cargo(name = "crates", ...)
+//
+// It returns nothing for a MODULE.bazel that does not parse.
+func crateUniverseRepos(module []byte) []string {
+	f, err := build.ParseModule("MODULE.bazel", module)
+	if err != nil {
+		return nil
+	}
+	// The names bound to the extension's proxy.
+	proxies := make(map[string]bool)
+	for _, stmt := range f.Stmt {
+		assign, ok := stmt.(*build.AssignExpr)
+		if !ok {
+			continue
+		}
+		lhs, ok1 := assign.LHS.(*build.Ident)
+		call, ok2 := assign.RHS.(*build.CallExpr)
+		if !ok1 || !ok2 || len(call.List) == 0 {
+			continue
+		}
+		if fn, ok := call.X.(*build.Ident); !ok || fn.Name != "use_extension" {
+			continue
+		}
+		if bzl, ok := call.List[0].(*build.StringExpr); ok && strings.Contains(bzl.Value, "crate_universe") {
+			proxies[lhs.Name] = true
+		}
+	}
+	var repos []string
+	for _, stmt := range f.Stmt {
+		call, ok := stmt.(*build.CallExpr)
+		if !ok {
+			continue
+		}
+		dot, ok := call.X.(*build.DotExpr)
+		if !ok {
+			continue
+		}
+		if x, ok := dot.X.(*build.Ident); !ok || !proxies[x.Name] {
+			continue
+		}
+		switch dot.Name {
+		case "from_cargo", "from_specs":
+			name := "crates" // the extension's default
+			for _, arg := range call.List {
+				if kw, ok := arg.(*build.AssignExpr); ok {
+					if k, ok := kw.LHS.(*build.Ident); ok && k.Name == "name" {
+						if v, ok := kw.RHS.(*build.StringExpr); ok {
+							name = v.Value
+						}
+					}
+				}
+			}
+			if !slices.Contains(repos, name) {
+				repos = append(repos, name)
+			}
+		}
+	}
+	return repos
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cell statuses recorded in the run state.
+const (
+	cellPending         = "pending"          // not started
+	cellRunning         = "running"          // started but not finished; resumed on -resume
+	cellSucceeded       = "succeeded"        // the target builds; Commit holds the result
+	cellFailed          = "failed"           // every attempt failed
+	cellError           = "error"            // a tool failed; retried on -resume
+	cellInterrupted     = "interrupted"      // bld was stopped; retried on -resume
+	cellOverBudget      = "over_budget"      // the model's budget ran out; retried on -resume
+	cellPolicyViolation = "policy_violation" // every attempt failed, the last by changing files outside policy.allowed_files
+)
+
+// cellState is the outcome of one model on one target.
+type cellState struct {
+	Model    string `json:"model"`
+	Target   string `json:"target"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// Retries counts the aider runs that crashed or hit a provider failure
+	// and were rerun; they are not attempts.
+	Retries int `json:"retries,omitempty"`
+	// PolicyViolations counts the attempts that changed files outside
+	// policy.allowed_files, whether they were rejected or the files
+	// reverted.
+	PolicyViolations int `json:"policy_violations,omitempty"`
+	// PromptVariant names the prompt templates of the latest attempts.
+	PromptVariant string `json:"prompt_variant,omitempty"`
+	// ArtifactDir holds a directory per attempt of the run recording the
+	// attempt's prompt, aider log, diff and bazel output; see
+	// attemptArtifacts.
+	ArtifactDir string `json:"artifact_dir,omitempty"`
+	// Commit is the worktree's HEAD once the target builds.
+	Commit string `json:"commit,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// WallSeconds is the time spent on the cell, summed over resumed runs.
+	WallSeconds float64 `json:"wall_seconds"`
+	// Usage totals AttemptUsage, which has an entry per attempt, including
+	// interrupted ones.
+	Usage        tokenUsage     `json:"usage"`
+	AttemptUsage []attemptUsage `json:"attempt_usage,omitempty"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// done reports whether a resumed run may skip the cell.
+func (c *cellState) done() bool {
+	return c.Status == cellSucceeded || c.Status == cellFailed || c.Status == cellPolicyViolation
+}
+
+// runState is the persistent record of a matrix run. It is rewritten after
+// every change so that an interrupted run can be resumed.
+type runState struct {
+	RunID     string       `json:"run_id"`
+	Repo      string       `json:"repo"`
+	Branch    string       `json:"branch"`
+	StartedAt time.Time    `json:"started_at"`
+	Cells     []*cellState `json:"cells"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// runStatePath returns the state file of runs of branch under worktreeBaseDir.
+func runStatePath(worktreeBaseDir, branch string) string {
+	return filepath.Join(worktreeBaseDir, "bld-state-"+sanitizePath(branch)+".json")
+}
+
+// newRunID returns an identifier for a run starting at t.
+func newRunID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// readRunState reads the state file at path.
+func readRunState(path string) (*runState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading run state: %w", err)
+	}
+	s := &runState{path: path}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("error parsing run state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// openRunState returns the state of the run recorded at path when resume is
+// set, or of a new run otherwise. A resumed run must be of the same
+// repository and branch.
+func openRunState(path string, resume bool, repo, branch string) (*runState, error) {
+	if resume {
+		s, err := readRunState(path)
+		if err != nil {
+			return nil, err
+		}
+		if s.Repo != repo || s.Branch != branch {
+			return nil, fmt.Errorf("run state %s is for %s (branch %s), not %s (branch %s)", path, s.Repo, s.Branch, repo, branch)
+		}
+		return s, nil
+	}
+	now := time.Now()
+	s := &runState{
+		RunID:     newRunID(now),
+		Repo:      repo,
+		Branch:    branch,
+		StartedAt: now,
+		path:      path,
+	}
+	return s, s.save()
+}
+
+// cell returns the state of model on target, adding a pending cell if the
+// run has none yet.
+func (s *runState) cell(model, target string) *cellState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.Cells {
+		if c.Model == model && c.Target == target {
+			return c
+		}
+	}
+	c := &cellState{Model: model, Target: target, Status: cellPending, UpdatedAt: time.Now()}
+	s.Cells = append(s.Cells, c)
+	return c
+}
+
+// modelUsage returns the usage of model summed over its cells.
+func (s *runState) modelUsage(model string) tokenUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var u tokenUsage
+	for _, c := range s.Cells {
+		if c.Model == model {
+			u.add(c.Usage)
+		}
+	}
+	return u
+}
+
+// overBudget returns what model has spent and reports whether that leaves
+// nothing of budget. A budget of zero is no limit.
+func (s *runState) overBudget(model string, budget float64) (float64, bool) {
+	spent := s.modelUsage(model).CostUSD
+	return spent, budget > 0 && spent >= budget
+}
+
+// update applies f to c and saves the state.
+func (s *runState) update(c *cellState, f func(c *cellState)) error {
+	s.mu.Lock()
+	f(c)
+	c.UpdatedAt = time.Now()
+	s.mu.Unlock()
+	return s.save()
+}
+
+// save writes the state file atomically.
+func (s *runState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding run state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("error creating dir for run state: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing run state: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error writing run state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunStateRoundTrip(t *testing.T) {
+	path := runStatePath(t.TempDir(), "feature/x")
+	if filepath.Base(path) != "bld-state-feature-x.json" {
+		t.Errorf("state file %s", path)
+	}
+	s, err := openRunState(path, false, "/repo", "feature/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{
+		"//a:succeeded":   cellSucceeded,
+		"//a:failed":      cellFailed,
+		"//a:violation":   cellPolicyViolation,
+		"//a:error":       cellError,
+		"//a:interrupted": cellInterrupted,
+		"//a:over_budget": cellOverBudget,
+		"//a:running":     cellRunning,
+	}
+	for target, status := range statuses {
+		if err := s.update(s.cell("m", target), func(c *cellState) {
+			c.Status = status
+			c.Attempts = 2
+			c.AttemptUsage = []attemptUsage{{Attempt: 1, tokenUsage: tokenUsage{PromptTokens: 10, CostUSD: 0.5}}}
+			c.Usage = tokenUsage{PromptTokens: 10, CostUSD: 0.5}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A cell that was never started is pending.
+	pending := s.cell("m", "//a:pending")
+
+	resumed, err := openRunState(path, true, "/repo", "feature/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.RunID != s.RunID || !resumed.StartedAt.Equal(s.StartedAt) {
+		t.Errorf("resumed run %s started %s, want %s started %s", resumed.RunID, resumed.StartedAt, s.RunID, s.StartedAt)
+	}
+	for target, status := range statuses {
+		got := resumed.cell("m", target)
+		want := *s.cell("m", target)
+		// Times lose their monotonic reading on the way through JSON.
+		if !got.UpdatedAt.Equal(want.UpdatedAt) {
+			t.Errorf("%s: updated at %s, want %s", target, got.UpdatedAt, want.UpdatedAt)
+		}
+		got.UpdatedAt = want.UpdatedAt
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: got %+v, want %+v", target, *got, want)
+		}
+		// -resume skips the cells whose outcome is final and retries the
+		// others, continuing after the attempts they used.
+		wantDone := status == cellSucceeded || status == cellFailed || status == cellPolicyViolation
+		if got.done() != wantDone {
+			t.Errorf("%s: done = %v, want %v", target, got.done(), wantDone)
+		}
+	}
+	if p := resumed.cell("m", "//a:pending"); p.done() || p.Status != pending.Status {
+		t.Errorf("pending cell resumed as %+v", p)
+	}
+	if u := resumed.modelUsage("m"); u.PromptTokens != 70 || u.CostUSD != 3.5 {
+		t.Errorf("usage of the resumed run = %+v", u)
+	}
+}
+
+func TestRunStateResumeOtherBranch(t *testing.T) {
+	path := runStatePath(t.TempDir(), "main")
+	if _, err := openRunState(path, false, "/repo", "main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRunState(path, true, "/other", "main"); err == nil || !strings.Contains(err.Error(), "not /other") {
+		t.Errorf("err = %v, want the repository mismatch reported", err)
+	}
+	if _, err := openRunState(filepath.Join(t.TempDir(), "none.json"), true, "/repo", "main"); err == nil {
+		t.Error("resumed a run without a state file")
+	}
+}
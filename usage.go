@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tokenUsage counts the tokens and dollars spent on LLM calls.
+type tokenUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+func (u *tokenUsage) add(v tokenUsage) {
+	u.PromptTokens += v.PromptTokens
+	u.CompletionTokens += v.CompletionTokens
+	u.CostUSD += v.CostUSD
+}
+
+// tokenUsage converts the usage reported by an API.
+func (u *chatUsage) tokenUsage() tokenUsage {
+	if u == nil {
+		return tokenUsage{}
+	}
+	return tokenUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, CostUSD: u.Cost}
+}
+
+// attemptUsage is the usage of one attempt at a cell, including the runs of
+// aider that failed and were retried.
+type attemptUsage struct {
+	Attempt int `json:"attempt"`
+	Retries int `json:"retries,omitempty"`
+	tokenUsage
+}
+
+var (
+	aiderSentRE     = regexp.MustCompile(`([\d.]+)([kM]?) sent`)
+	aiderReceivedRE = regexp.MustCompile(`([\d.]+)([kM]?) received`)
+	aiderCostRE     = regexp.MustCompile(`Cost: \$([\d.]+) message`)
+)
+
+// parseAiderUsage sums the usage aider reports after each message, in lines
+// such as
+//
+//	Tokens: 2.3k sent, 1.1k cache hit, 120 received. Cost: $0.01 message, $0.05 session.
+//
+// Aider rounds token counts, so the totals are approximate.
+func parseAiderUsage(out []byte) tokenUsage {
+	var u tokenUsage
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if !strings.HasPrefix(line, "Tokens: ") {
+			continue
+		}
+		if m := aiderSentRE.FindStringSubmatch(line); m != nil {
+			u.PromptTokens += parseTokenCount(m[1], m[2])
+		}
+		if m := aiderReceivedRE.FindStringSubmatch(line); m != nil {
+			u.CompletionTokens += parseTokenCount(m[1], m[2])
+		}
+		if m := aiderCostRE.FindStringSubmatch(line); m != nil {
+			if cost, err := strconv.ParseFloat(m[1], 64); err == nil {
+				u.CostUSD += cost
+			}
+		}
+	}
+	return u
+}
+
+// parseTokenCount parses a count such as "2.3" with suffix "k".
+func parseTokenCount(num, suffix string) int {
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	switch suffix {
+	case "k":
+		n *= 1e3
+	case "M":
+		n *= 1e6
+	}
+	return int(n)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAiderUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want tokenUsage
+	}{
+		{
+			name: "one message",
+			out:  "Applied edit to BUILD.bazel\nTokens: 2.3k sent, 120 received. Cost: $0.01 message, $0.05 session.\n",
+			want: tokenUsage{PromptTokens: 2300, CompletionTokens: 120, CostUSD: 0.01},
+		},
+		{
+			name: "cache hits and several messages",
+			out: "Tokens: 1.5M sent, 1.1k cache hit, 2k received. Cost: $1.25 message, $1.25 session.\n" +
+				"bazel build failed\n" +
+				"  Tokens: 500 sent, 40 received. Cost: $0.0040 message, $1.2540 session.\n",
+			want: tokenUsage{PromptTokens: 1500500, CompletionTokens: 2040, CostUSD: 1.254},
+		},
+		{
+			name: "no cost reported",
+			out:  "Tokens: 800 sent, 12 received.\n",
+			want: tokenUsage{PromptTokens: 800, CompletionTokens: 12},
+		},
+		{
+			name: "not a usage line",
+			out:  "Use Tokens: 800 sent to check\nThe model sent 3 received 4\n",
+		},
+		{
+			name: "no output",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseAiderUsage([]byte(tc.out))
+			// Costs are summed in floating point.
+			if got.PromptTokens != tc.want.PromptTokens || got.CompletionTokens != tc.want.CompletionTokens || int(got.CostUSD*1e6+0.5) != int(tc.want.CostUSD*1e6+0.5) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOverBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		budget float64
+		costs  []float64 // of model m's cells
+		want   bool
+	}{
+		{name: "no budget", costs: []float64{100}},
+		{name: "nothing spent", budget: 1},
+		{name: "under", budget: 1, costs: []float64{0.25, 0.5}},
+		{name: "spent exactly", budget: 1, costs: []float64{0.5, 0.5}, want: true},
+		{name: "over", budget: 1, costs: []float64{2}, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &runState{}
+			for i, cost := range tc.costs {
+				s.cell("m", "//t:"+string(rune('a'+i))).Usage.CostUSD = cost
+			}
+			// Other models' spending does not count.
+			s.cell("n", "//t:a").Usage.CostUSD = 1000
+			spent, over := s.overBudget("m", tc.budget)
+			if over != tc.want {
+				t.Errorf("over budget = %v after $%.2f, want %v", over, spent, tc.want)
+			}
+		})
+	}
+}
+
+func TestCachedRepliesCostNothing(t *testing.T) {
+	ctx := context.Background()
+	cache := &responseCache{dir: t.TempDir()}
+	p := &fakeProvider{reply: "rust_library()", usage: &chatUsage{PromptTokens: 1000, CompletionTokens: 100, Cost: 0.6}}
+	req := completionRequest{Model: "m", System: "prompt", Input: []byte("input")}
+	s := &runState{path: filepath.Join(t.TempDir(), "state.json")}
+	for _, target := range []string{"//a:a", "//b:b", "//c:c"} {
+		c, err := cache.complete(ctx, p, "openrouter", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.update(s.cell("m", target), func(cs *cellState) { cs.Usage.add(c.Usage.tokenUsage()) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first request was paid for, so a budget of $1 is not spent.
+	if spent, over := s.overBudget("m", 1); over || spent != 0.6 {
+		t.Errorf("spent $%.2f, over budget %v; want $0.60 and not over", spent, over)
+	}
+	if u := s.modelUsage("m"); u.PromptTokens != 1000 || u.CompletionTokens != 100 {
+		t.Errorf("usage = %+v, want only the first request's", u)
+	}
+}